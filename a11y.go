@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AltText returns the alt text of the main image of the post, its caption
+// when no alt text is set.
+func (p Post) AltText() string {
+	if p.Alt != "" {
+		return p.Alt
+	}
+	return p.Caption
+}
+
+// AltText returns the alt text of a gallery image, its caption when no alt
+// text is set.
+func (img PostImage) AltText() string {
+	if img.Alt != "" {
+		return img.Alt
+	}
+	return img.Caption
+}
+
+// missingAltImages returns the images of the post without alt text.
+func (p Post) missingAltImages() []string {
+	var missing []string
+	if p.Image != "" && strings.TrimSpace(p.AltText()) == "" {
+		missing = append(missing, p.Image)
+	}
+	for _, image := range p.Images {
+		if strings.TrimSpace(image.AltText()) == "" {
+			missing = append(missing, image.Src)
+		}
+	}
+	return missing
+}
+
+// postsMissingAlt returns the posts with images missing alt text.
+func postsMissingAlt(posts []Post) []Post {
+	var missing []Post
+	for _, post := range posts {
+		if len(post.missingAltImages()) > 0 {
+			missing = append(missing, post)
+		}
+	}
+	return missing
+}
+
+// printMissingAlt prints the posts with images missing alt text, with the
+// images.
+func printMissingAlt(w io.Writer, posts []Post) {
+	fmt.Fprintf(w, "%d posts have images without alt text:\n", len(posts))
+	for _, post := range posts {
+		fmt.Fprintf(w, "  %s: %s\n", post.Title, strings.Join(post.missingAltImages(), ", "))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// apiDir is where the JSON API is written, in the output directory.
+const apiDir = "api/posts"
+
+// apiPage is a page of the JSON API of posts, docs/api/posts/page-N.json.
+type apiPage struct {
+	Posts     []apiPost `json:"posts"`
+	Total     int       `json:"total"`
+	Page      int       `json:"page"`
+	PageCount int       `json:"pageCount"`
+	PageSize  int       `json:"pageSize"`
+	Prev      string    `json:"prev,omitempty"`
+	Next      string    `json:"next,omitempty"`
+}
+
+// apiPost is a post in the JSON API.
+type apiPost struct {
+	Title       string     `json:"title"`
+	Caption     string     `json:"caption"`
+	CaptionHTML string     `json:"captionHtml,omitempty"`
+	URL         string     `json:"url,omitempty"`
+	Image       string     `json:"image,omitempty"`
+	ImageWidth  int        `json:"imageWidth,omitempty"`
+	ImageHeight int        `json:"imageHeight,omitempty"`
+	Thumbnail   string     `json:"thumbnail,omitempty"`
+	Images      []apiImage `json:"images,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Date        string     `json:"date,omitempty"`
+	Pinned      bool       `json:"pinned,omitempty"`
+	Params      Params     `json:"params,omitempty"`
+}
+
+// apiImage is a gallery image of a post in the JSON API.
+type apiImage struct {
+	URL     string `json:"url"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Alt     string `json:"alt,omitempty"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// apiPageName matches the file names of the API pages.
+var apiPageName = regexp.MustCompile(`^page-(\d+)\.json$`)
+
+// writeAPI writes posts, in the order of the index, as pages of pageSize
+// posts into dir, page-1.json and on, split like the index pages. Pages left
+// from a build with more of them are removed. URLs are absolute when
+// baseURL is set.
+func writeAPI(dir string, cfg Config, posts []Post, pageSize int) error {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	link := func(n int) string {
+		return apiURL(cfg.BaseURL, fmt.Sprintf("/%s/page-%d.json", apiDir, n))
+	}
+	pages := paginate(posts, pageSize, "/")
+	for _, page := range pages {
+		pagination := page.Pagination
+		data := apiPage{
+			Posts:     make([]apiPost, 0, len(page.Posts)),
+			Total:     pagination.TotalPosts,
+			Page:      pagination.Page,
+			PageCount: pagination.PageCount,
+			PageSize:  pagination.PageSize,
+		}
+		if pagination.PrevURL != "" {
+			data.Prev = link(pagination.Page - 1)
+		}
+		if pagination.NextURL != "" {
+			data.Next = link(pagination.Page + 1)
+		}
+		for _, post := range page.Posts {
+			data.Posts = append(data.Posts, newAPIPost(post, cfg.BaseURL))
+		}
+
+		output, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("page-%d.json", pagination.Page))
+		err = os.WriteFile(path, append(output, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		match := apiPageName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		if n, _ := strconv.Atoi(match[1]); n > len(pages) || n < 1 {
+			err = os.Remove(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newAPIPost returns the post as it is listed in the JSON API.
+func newAPIPost(post Post, baseURL string) apiPost {
+	result := apiPost{
+		Title:       post.Title,
+		Caption:     post.Caption,
+		CaptionHTML: string(post.CaptionHTML),
+		URL:         apiURL(baseURL, post.URL),
+		Image:       apiURL(baseURL, post.ImageURL),
+		ImageWidth:  post.ImageWidth,
+		ImageHeight: post.ImageHeight,
+		Thumbnail:   apiURL(baseURL, post.ThumbnailURL),
+		Tags:        post.Tags,
+		Date:        post.Date,
+		Pinned:      post.Pinned(),
+		Params:      post.Params,
+	}
+	for _, image := range post.Images {
+		result.Images = append(result.Images, apiImage{
+			URL:     apiURL(baseURL, image.URL),
+			Width:   image.Width,
+			Height:  image.Height,
+			Alt:     image.Alt,
+			Caption: image.Caption,
+		})
+	}
+	return result
+}
+
+// apiURL returns the site relative path made absolute with baseURL when it
+// is set. An empty path stays empty.
+func apiURL(baseURL string, path string) string {
+	if baseURL == "" || path == "" {
+		return path
+	}
+	return absoluteURL(baseURL, path)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// readAPIPage returns page n of the JSON API in dir.
+func readAPIPage(t *testing.T, dir string, n int) apiPage {
+	t.Helper()
+	var page apiPage
+	contents := readTestFile(t, filepath.Join(dir, fmt.Sprintf("page-%d.json", n)))
+	if err := json.Unmarshal([]byte(contents), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestWriteAPIPages(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "api", "posts")
+	var posts []Post
+	for _, title := range []string{"A", "B", "C", "D", "E"} {
+		posts = append(posts, Post{Title: title, URL: "/posts/" + slugify(title) + "/"})
+	}
+	// Pages of a previous build with more posts.
+	writeTestFile(t, filepath.Join(dir, "page-4.json"), "{}")
+	writeTestFile(t, filepath.Join(dir, "notes.json"), "{}")
+
+	if err := writeAPI(dir, defaultConfig(), posts, 2); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		titles []string
+		prev   string
+		next   string
+	}{
+		{[]string{"A", "B"}, "", "/api/posts/page-2.json"},
+		{[]string{"C", "D"}, "/api/posts/page-1.json", "/api/posts/page-3.json"},
+		{[]string{"E"}, "/api/posts/page-2.json", ""},
+	}
+	for i, test := range tests {
+		page := readAPIPage(t, dir, i+1)
+		var titles []string
+		for _, post := range page.Posts {
+			titles = append(titles, post.Title)
+		}
+		if !slices.Equal(titles, test.titles) {
+			t.Errorf("page %d has %v, want %v", i+1, titles, test.titles)
+		}
+		if page.Total != 5 || page.Page != i+1 || page.PageCount != 3 || page.PageSize != 2 {
+			t.Errorf("page %d: total %d, page %d of %d, size %d, want total 5, page %d of 3, size 2",
+				i+1, page.Total, page.Page, page.PageCount, page.PageSize, i+1)
+		}
+		if page.Prev != test.prev || page.Next != test.next {
+			t.Errorf("page %d: prev %q and next %q, want %q and %q", i+1, page.Prev, page.Next, test.prev, test.next)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "page-4.json")); !os.IsNotExist(err) {
+		t.Errorf("stale page-4.json was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.json")); err != nil {
+		t.Errorf("file other than a page was removed: %v", err)
+	}
+
+	// Without a page size every post is on one page.
+	if err := writeAPI(dir, defaultConfig(), posts, 0); err != nil {
+		t.Fatal(err)
+	}
+	page := readAPIPage(t, dir, 1)
+	if len(page.Posts) != 5 || page.PageCount != 1 || page.Prev != "" || page.Next != "" {
+		t.Errorf("single page has %d posts, page count %d, prev %q and next %q, want 5 posts alone",
+			len(page.Posts), page.PageCount, page.Prev, page.Next)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "page-2.json")); !os.IsNotExist(err) {
+		t.Errorf("stale page-2.json was kept")
+	}
+}
+
+func TestWriteAPIAbsoluteURLs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://example.com/blog"
+	posts := []Post{
+		{Title: "A", URL: "/posts/a/", ImageURL: "/images/a.jpg"},
+		{Title: "B", URL: "/posts/b/"},
+	}
+
+	if err := writeAPI(dir, cfg, posts, 1); err != nil {
+		t.Fatal(err)
+	}
+	page := readAPIPage(t, dir, 1)
+	if want := "https://example.com/blog/api/posts/page-2.json"; page.Next != want {
+		t.Errorf("next is %q, want %q", page.Next, want)
+	}
+	post := page.Posts[0]
+	if post.URL != "https://example.com/blog/posts/a/" || post.Image != "https://example.com/blog/images/a.jpg" {
+		t.Errorf("post URLs are %q and %q, want them absolute", post.URL, post.Image)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormats are the archive formats by file name suffix.
+var archiveFormats = map[string]string{
+	".tar.gz": "tar.gz",
+	".tgz":    "tar.gz",
+	".tar":    "tar",
+	".zip":    "zip",
+}
+
+// archiveFormat returns the format of the archive at path, by its suffix.
+func archiveFormat(path string) (string, error) {
+	for suffix, format := range archiveFormats {
+		if strings.HasSuffix(strings.ToLower(path), suffix) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown archive format for %s, use .tar.gz, .tgz, .tar or .zip", path)
+}
+
+// writeArchive packs the files of the built site in outputDir into an
+// archive at path, with paths relative to outputDir. The files bricksling
+// keeps for itself at the top of outputDir, like the image cache, are left
+// out. The archive is written next to path first and moved in place once
+// complete, so a deploy never picks up a partial one.
+func writeArchive(path string, outputDir string) error {
+	format, err := archiveFormat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	count, err := packArchive(tmp, format, outputDir)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing archive: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Packed %d files into %s.\n", count, path)
+	return nil
+}
+
+// packArchive writes the files under outputDir to w in the format and
+// returns how many it wrote.
+func packArchive(w io.Writer, format string, outputDir string) (int, error) {
+	var add func(name string, info fs.FileInfo, path string) error
+	var finish func() error
+	switch format {
+	case "zip":
+		zw := zip.NewWriter(w)
+		add = func(name string, info fs.FileInfo, path string) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			header.Method = zip.Deflate
+			entry, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			return copyFileTo(entry, path)
+		}
+		finish = zw.Close
+	default:
+		var gz *gzip.Writer
+		if format == "tar.gz" {
+			gz = gzip.NewWriter(w)
+			w = gz
+		}
+		tw := tar.NewWriter(w)
+		add = func(name string, info fs.FileInfo, path string) error {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+			err = tw.WriteHeader(header)
+			if err != nil {
+				return err
+			}
+			return copyFileTo(tw, path)
+		}
+		finish = func() error {
+			err := tw.Close()
+			if err == nil && gz != nil {
+				err = gz.Close()
+			}
+			return err
+		}
+	}
+
+	count := 0
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.Contains(name, "/") && strings.HasPrefix(name, ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		count++
+		return add(name, info, path)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, finish()
+}
+
+// copyFileTo copies the contents of the file at path to w.
+func copyFileTo(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveEntries returns the contents of the files in the archive at path,
+// by name.
+func archiveEntries(t *testing.T, path string, format string) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	if format == "zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		for _, file := range zr.File {
+			r, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[file.Name] = string(contents)
+		}
+		return entries
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name] = string(contents)
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	outputDir := filepath.Join(t.TempDir(), "docs")
+	want := map[string]string{
+		"index.html":             "<h1>Index</h1>",
+		"images/a.jpg":           "jpeg",
+		"posts/a/index.html":     "<h1>A</h1>",
+		"images/.well-known.txt": "kept",
+	}
+	for name, contents := range want {
+		writeTestFile(t, filepath.Join(outputDir, filepath.FromSlash(name)), contents)
+	}
+	writeTestFile(t, filepath.Join(outputDir, ".image-cache.json"), "{}")
+
+	for _, name := range []string{"site.tar.gz", "site.tgz", "site.tar", "site.zip"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := writeArchive(path, outputDir); err != nil {
+				t.Fatal(err)
+			}
+			format, err := archiveFormat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := archiveEntries(t, path, format); !maps.Equal(got, want) {
+				t.Errorf("archive holds %v, want %v", got, want)
+			}
+			leftovers, err := filepath.Glob(filepath.Join(filepath.Dir(path), ".archive-*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leftovers) > 0 {
+				t.Errorf("temporary archive left behind: %v", leftovers)
+			}
+		})
+	}
+
+	err := writeArchive(filepath.Join(t.TempDir(), "site.rar"), outputDir)
+	if err == nil || !strings.Contains(err.Error(), "unknown archive format") {
+		t.Errorf("writeArchive to a .rar returned %v, want an unknown format error", err)
+	}
+}
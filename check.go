@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runCheck reports problems with the posts of index.json, drafts and
+// scheduled posts included, without writing anything.
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	strict := flags.Bool("strict-a11y", false, "fail when images are missing alt text")
+	failOnWarnings := flags.Bool("fail-on-warnings", false, "fail when there are any warnings")
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	postsData, _, err := readPosts(cfg, "source/index.json")
+	if err != nil {
+		return err
+	}
+
+	unusedImages, err := findUnusedImages(postsData, "source/images", cfg.IgnoreImages)
+	if err != nil {
+		return fmt.Errorf("error finding unused images: %w", err)
+	}
+	for _, image := range unusedImages {
+		fmt.Printf("Image %s is not used by any post\n", image)
+	}
+
+	missingAlt := postsMissingAlt(postsData.Posts)
+	if len(missingAlt) > 0 {
+		printMissingAlt(os.Stdout, missingAlt)
+	}
+
+	warnings := len(unusedImages) + len(missingAlt)
+	if warnings == 0 {
+		fmt.Printf("Checked %d posts, no problems found.\n", len(postsData.Posts))
+		return nil
+	}
+	fmt.Printf("Checked %d posts, %d warnings.\n", len(postsData.Posts), warnings)
+	if *strict && len(missingAlt) > 0 {
+		return fmt.Errorf("%d posts have images without alt text", len(missingAlt))
+	}
+	if *failOnWarnings {
+		return fmt.Errorf("%d warnings", warnings)
+	}
+	return nil
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+	_ "time/tzdata"
+)
+
+// Config holds the site settings. Values are read from bricksling.json when
+// it exists; anything left out keeps its default.
+type Config struct {
+	// BaseURL is the absolute URL the site is served from, for example
+	// "https://bricksling.com". Features needing absolute URLs are skipped
+	// when it is empty.
+	BaseURL string `json:"baseURL"`
+	// SQLite reads the posts from a database table instead of index.json.
+	SQLite SQLiteSource `json:"sqlite"`
+	// Profiles are the output directories the site is built into, each
+	// with its own base URL. Without any the site is built into docs with
+	// BaseURL.
+	Profiles []Profile `json:"profiles"`
+	// Title and Description describe the site in feeds.
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Author is the name the Atom feed credits the site to. It defaults to
+	// the title.
+	Author string `json:"author"`
+	// TemplateEngine is the engine templates are written for, "html" for
+	// html/template.
+	TemplateEngine string `json:"templateEngine"`
+	// CaptionPolicy is how much HTML captions rendered with .CaptionHTML may
+	// hold: "strict" for none, "basic" for text formatting and links, or
+	// "ugc" for what user generated content usually needs.
+	CaptionPolicy string `json:"captionPolicy"`
+	// CaptionLength is the length in characters captions are cut to for
+	// .ShortCaption. Zero keeps them whole.
+	CaptionLength int `json:"captionLength"`
+	// AboveFold is the number of posts at the top of every page whose image
+	// loads eagerly with a high fetch priority, the others loading lazily.
+	AboveFold int `json:"aboveFold"`
+	// DateFormat is how post dates are formatted for templates, a Go time
+	// layout like "Jan 2, 2006" or one of the namedDateFormats, and
+	// Timezone the IANA time zone they are shown in, like "Europe/Berlin".
+	DateFormat string `json:"dateFormat"`
+	Timezone   string `json:"timezone"`
+	// PageSize is the number of posts per index page. Zero keeps every post
+	// on a single index page.
+	PageSize int `json:"pageSize"`
+	// TagPageSize is the number of posts per tag page. Zero puts every post
+	// of a tag on a single page.
+	TagPageSize int `json:"tagPageSize"`
+	// IgnoreImages are patterns of files in source/images that are never
+	// added to index.json. "dir/" skips a directory, anything else is a glob
+	// matched against the relative path and the file name.
+	IgnoreImages []string `json:"ignoreImages"`
+	// ProcessImages is "resize" to resize and encode images with the image
+	// settings below, or "copy" to copy them to the output verbatim.
+	ProcessImages string `json:"processImages"`
+	// ImageWidth is the width output images are resized to.
+	ImageWidth int `json:"imageWidth"`
+	// ImageFormat is the output image format, "jpeg" or "png".
+	ImageFormat string `json:"imageFormat"`
+	// ImageQuality is the JPEG quality, 1 to 100.
+	ImageQuality int `json:"imageQuality"`
+	// PNGCompression is the PNG compression level: "default", "none",
+	// "fast" or "best".
+	PNGCompression string `json:"pngCompression"`
+	// PNGColors reduces PNG output to a palette of at most that many colors,
+	// 2 to 256. Zero keeps every color.
+	PNGColors int `json:"pngColors"`
+	// ImageFilter is the resize filter: "nearest", "bilinear", "bicubic",
+	// "mitchellnetravali", "lanczos2" or "lanczos3".
+	ImageFilter string `json:"imageFilter"`
+	// FlattenBackground is the "#rrggbb" color transparent images are
+	// flattened onto when encoded to JPEG.
+	FlattenBackground string `json:"flattenBackground"`
+	// ResponsiveWidths are the widths of the responsive variants generated
+	// next to the main image.
+	ResponsiveWidths []int `json:"responsiveWidths"`
+	// SrcsetDescriptor is how the srcset of responsive images describes the
+	// variants: "width" for the responsiveWidths with 480w descriptors and
+	// a sizes attribute, "density" for the imageDensities with 2x
+	// descriptors.
+	SrcsetDescriptor string `json:"srcsetDescriptor"`
+	// ImageDensities are the pixel densities of the variants generated next
+	// to the main image, the 1x, with density descriptors.
+	ImageDensities []float64 `json:"imageDensities"`
+	// ImageSizes is the sizes attribute going with the srcset of responsive
+	// images, and TagImageSizes its value on tag pages when they lay images
+	// out differently. Neither is used with density descriptors.
+	ImageSizes    string `json:"imageSizes"`
+	TagImageSizes string `json:"tagImageSizes"`
+	// ImageLayout names the responsive variants: "flat" writes
+	// images/name-480.jpg, "dirs" writes images/480/name.jpg.
+	ImageLayout string `json:"imageLayout"`
+	// InlineBelowBytes inlines images smaller than that many bytes into
+	// pages as data URIs. Zero inlines nothing.
+	InlineBelowBytes int64 `json:"inlineBelowBytes"`
+	// ThumbnailSize is the side of the square thumbnails generated for the
+	// posts needing one. Zero disables thumbnails.
+	ThumbnailSize int `json:"thumbnailSize"`
+	// DefaultImage is the path of an image used as it is for posts without
+	// an image or whose image is missing, instead of failing.
+	DefaultImage string `json:"defaultImage"`
+	// KeepOriginalGIF copies GIF sources next to their static thumbnails,
+	// so animations can still be linked to.
+	KeepOriginalGIF bool `json:"keepOriginalGIF"`
+	// ImageNaming names output images after the source file, "basename",
+	// or after the post title, "slug".
+	ImageNaming string `json:"imageNaming"`
+	// LatestCount is the number of newest posts written to latest.json.
+	// Zero disables latest.json.
+	LatestCount int `json:"latestCount"`
+	// API writes the posts as paginated JSON into api/posts, APIPageSize
+	// posts per page. Zero pages like the index, with PageSize.
+	API         bool `json:"api"`
+	APIPageSize int  `json:"apiPageSize"`
+	// ImageWorkers is the number of images processed in parallel.
+	ImageWorkers int `json:"imageWorkers"`
+	// MaxOpenFiles caps the files the image pipeline keeps open at once,
+	// whatever the number of workers.
+	MaxOpenFiles int `json:"maxOpenFiles"`
+	// MaxTotalBytes is the size budget of each output directory. Zero
+	// disables it.
+	MaxTotalBytes int64 `json:"maxTotalBytes"`
+	// BudgetAction is what exceeding MaxTotalBytes does, "warn" or "fail".
+	BudgetAction string `json:"budgetAction"`
+	// PurgeWebhook is the URL the purge command posts the changed URLs to.
+	PurgeWebhook string `json:"purgeWebhook"`
+	// PostBuild is a shell command run after every successful build, with
+	// the output directory as $1 and in BRICKSLING_OUTPUT_DIR. A non-zero
+	// exit fails the build. It runs with the permissions of bricksling, so
+	// only configure commands you trust.
+	PostBuild string `json:"postBuild"`
+	// WatchScope is what --watch watches: "all", "template", "data" or
+	// "images".
+	WatchScope string `json:"watchScope"`
+	// Autocert serves the site over HTTPS with Let's Encrypt certificates.
+	Autocert AutocertConfig `json:"autocert"`
+}
+
+// SQLiteSource configures reading posts from a SQLite database. It is off
+// unless Path is set.
+type SQLiteSource struct {
+	Path  string `json:"path"`
+	Table string `json:"table"`
+	// Columns maps post fields, as named in index.json, to the columns
+	// they are read from when named differently.
+	Columns map[string]string `json:"columns"`
+	// OrderBy is an SQL ORDER BY clause for the posts, like "date DESC".
+	OrderBy string `json:"orderBy"`
+	// AutoAdd inserts a row for each new image, like the build does for
+	// index.json. When off new images are only reported.
+	AutoAdd bool `json:"autoAdd"`
+}
+
+// Profile is an output directory the site is built into.
+type Profile struct {
+	OutputDir string `json:"outputDir"`
+	// BaseURL is the URL the directory is served from. It defaults to the
+	// BaseURL of the config.
+	BaseURL string `json:"baseURL"`
+}
+
+// AutocertConfig configures HTTPS serving with automatic certificates. It is
+// off unless Domains is set.
+type AutocertConfig struct {
+	// Domains are the host names certificates are requested for. Requests
+	// for any other host are refused.
+	Domains []string `json:"domains"`
+	// CacheDir is where certificates are kept between runs.
+	CacheDir string `json:"cacheDir"`
+	// Email is the optional contact address given to Let's Encrypt.
+	Email string `json:"email"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		TemplateEngine:    "html",
+		CaptionPolicy:     "basic",
+		PageSize:          0,
+		TagPageSize:       24,
+		ProcessImages:     "resize",
+		ImageWidth:        1440,
+		ImageFormat:       "jpeg",
+		ImageQuality:      jpeg.DefaultQuality,
+		PNGCompression:    "default",
+		ImageFilter:       "lanczos3",
+		FlattenBackground: "#ffffff",
+		ImageSizes:        "100vw",
+		SrcsetDescriptor:  "width",
+		ImageDensities:    []float64{2},
+		AboveFold:         1,
+		DateFormat:        "Jan 2, 2006",
+		Timezone:          "UTC",
+		ImageLayout:       "flat",
+		ImageNaming:       "basename",
+		ImageWorkers:      runtime.NumCPU(),
+		MaxOpenFiles:      64,
+		SQLite:            SQLiteSource{Table: "posts"},
+		BudgetAction:      "warn",
+		WatchScope:        "all",
+		Autocert:          AutocertConfig{CacheDir: ".autocert-cache"},
+	}
+}
+
+// loadConfig reads the config file at path on top of the defaults. A missing
+// file is not an error.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	byteValue, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(byteValue, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (cfg Config) validate() error {
+	if _, ok := templateEngines[cfg.TemplateEngine]; !ok {
+		return fmt.Errorf("unknown templateEngine %q", cfg.TemplateEngine)
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", cfg.Timezone)
+	}
+	if layout := dateLayout(cfg.DateFormat); time.Date(2001, 3, 4, 5, 6, 7, 0, time.UTC).Format(layout) == layout {
+		return fmt.Errorf("dateFormat %q is neither a Go time layout nor a named format", cfg.DateFormat)
+	}
+	if cfg.AboveFold < 0 {
+		return fmt.Errorf("aboveFold can't be negative, got %d", cfg.AboveFold)
+	}
+	if cfg.CaptionLength < 0 {
+		return fmt.Errorf("captionLength can't be negative, got %d", cfg.CaptionLength)
+	}
+	if _, ok := captionPolicies[cfg.CaptionPolicy]; !ok {
+		return fmt.Errorf("unknown captionPolicy %q", cfg.CaptionPolicy)
+	}
+	if cfg.SQLite.Path != "" && cfg.SQLite.Table == "" {
+		return fmt.Errorf("sqlite needs a table")
+	}
+	for field := range cfg.SQLite.Columns {
+		if !slices.Contains(sqliteFields, field) {
+			return fmt.Errorf("unknown sqlite column field %q", field)
+		}
+	}
+	outputDirs := make(map[string]bool)
+	for _, profile := range cfg.Profiles {
+		if profile.OutputDir == "" {
+			return fmt.Errorf("profiles need an outputDir")
+		}
+		dir := filepath.Clean(profile.OutputDir)
+		if outputDirs[dir] {
+			return fmt.Errorf("outputDir %q is used by several profiles", profile.OutputDir)
+		}
+		outputDirs[dir] = true
+	}
+	for _, pattern := range cfg.IgnoreImages {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignoreImages pattern %q: %w", pattern, err)
+		}
+	}
+	if cfg.ProcessImages != "resize" && cfg.ProcessImages != "copy" {
+		return fmt.Errorf("unknown processImages %q", cfg.ProcessImages)
+	}
+	if cfg.ImageWidth <= 0 {
+		return fmt.Errorf("imageWidth must be positive, got %d", cfg.ImageWidth)
+	}
+	if _, ok := imageExtensions[cfg.ImageFormat]; !ok {
+		return fmt.Errorf("unknown imageFormat %q", cfg.ImageFormat)
+	}
+	if cfg.ImageQuality < 1 || cfg.ImageQuality > 100 {
+		return fmt.Errorf("imageQuality must be between 1 and 100, got %d", cfg.ImageQuality)
+	}
+	if _, ok := pngCompressionLevels[cfg.PNGCompression]; !ok {
+		return fmt.Errorf("unknown pngCompression %q", cfg.PNGCompression)
+	}
+	if cfg.PNGColors != 0 && (cfg.PNGColors < 2 || cfg.PNGColors > 256) {
+		return fmt.Errorf("pngColors must be between 2 and 256, got %d", cfg.PNGColors)
+	}
+	if _, ok := resizeFilters[cfg.ImageFilter]; !ok {
+		return fmt.Errorf("unknown imageFilter %q", cfg.ImageFilter)
+	}
+	if _, err := parseHexColor(cfg.FlattenBackground); err != nil {
+		return fmt.Errorf("flattenBackground: %w", err)
+	}
+	for _, width := range cfg.ResponsiveWidths {
+		if width <= 0 || width == cfg.ImageWidth {
+			return fmt.Errorf("responsiveWidths must be positive and differ from imageWidth, got %d", width)
+		}
+	}
+	switch cfg.SrcsetDescriptor {
+	case "width":
+	case "density":
+		if len(cfg.ResponsiveWidths) > 0 {
+			return fmt.Errorf("responsiveWidths need srcsetDescriptor width, use imageDensities with density")
+		}
+		for _, density := range cfg.ImageDensities {
+			if density <= 1 {
+				return fmt.Errorf("imageDensities must be above 1, got %g", density)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown srcsetDescriptor %q", cfg.SrcsetDescriptor)
+	}
+	if len(cfg.ResponsiveWidths) > 0 && strings.TrimSpace(cfg.ImageSizes) == "" {
+		return fmt.Errorf("imageSizes can't be empty with responsiveWidths")
+	}
+	if cfg.ImageLayout != "flat" && cfg.ImageLayout != "dirs" {
+		return fmt.Errorf("unknown imageLayout %q", cfg.ImageLayout)
+	}
+	if cfg.InlineBelowBytes < 0 {
+		return fmt.Errorf("inlineBelowBytes can't be negative, got %d", cfg.InlineBelowBytes)
+	}
+	if cfg.ThumbnailSize < 0 {
+		return fmt.Errorf("thumbnailSize can't be negative, got %d", cfg.ThumbnailSize)
+	}
+	if cfg.ImageNaming != "basename" && cfg.ImageNaming != "slug" {
+		return fmt.Errorf("unknown imageNaming %q", cfg.ImageNaming)
+	}
+	if cfg.ImageWorkers < 1 {
+		return fmt.Errorf("imageWorkers must be at least 1, got %d", cfg.ImageWorkers)
+	}
+	if cfg.MaxOpenFiles < 1 {
+		return fmt.Errorf("maxOpenFiles must be at least 1, got %d", cfg.MaxOpenFiles)
+	}
+	if cfg.MaxTotalBytes < 0 {
+		return fmt.Errorf("maxTotalBytes can't be negative, got %d", cfg.MaxTotalBytes)
+	}
+	if cfg.BudgetAction != "warn" && cfg.BudgetAction != "fail" {
+		return fmt.Errorf("unknown budgetAction %q", cfg.BudgetAction)
+	}
+	if !validWatchScope(cfg.WatchScope) {
+		return fmt.Errorf("unknown watchScope %q", cfg.WatchScope)
+	}
+	for _, domain := range cfg.Autocert.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			return fmt.Errorf("invalid autocert domain %q", domain)
+		}
+	}
+	if len(cfg.Autocert.Domains) > 0 && cfg.Autocert.CacheDir == "" {
+		return fmt.Errorf("autocert needs a cacheDir")
+	}
+	return nil
+}
+
+// location returns the time zone of post dates. It is checked by validate.
+func (cfg Config) location() *time.Location {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// densities returns the pixel densities of the responsive variants, none
+// with width descriptors.
+func (cfg Config) densities() []float64 {
+	if cfg.SrcsetDescriptor != "density" {
+		return nil
+	}
+	return cfg.ImageDensities
+}
+
+// indexImageSizes returns the sizes attribute of images on the index and
+// post pages, none with density descriptors.
+func (cfg Config) indexImageSizes() string {
+	if cfg.SrcsetDescriptor == "density" {
+		return ""
+	}
+	return cfg.ImageSizes
+}
+
+// tagImageSizes returns the sizes attribute of images on tag pages, none
+// with density descriptors.
+func (cfg Config) tagImageSizes() string {
+	if cfg.TagImageSizes != "" && cfg.SrcsetDescriptor != "density" {
+		return cfg.TagImageSizes
+	}
+	return cfg.indexImageSizes()
+}
+
+// apiPageSize returns the number of posts per page of the JSON API.
+func (cfg Config) apiPageSize() int {
+	if cfg.APIPageSize > 0 {
+		return cfg.APIPageSize
+	}
+	return cfg.PageSize
+}
+
+// outputProfiles returns the profiles the site is built into, the first one
+// being where images are processed.
+func (cfg Config) outputProfiles() []Profile {
+	if len(cfg.Profiles) == 0 {
+		return []Profile{{OutputDir: "docs", BaseURL: cfg.BaseURL}}
+	}
+	profiles := slices.Clone(cfg.Profiles)
+	for i := range profiles {
+		if profiles[i].BaseURL == "" {
+			profiles[i].BaseURL = cfg.BaseURL
+		}
+	}
+	return profiles
+}
+
+// imageSettings returns the settings output images are encoded with.
+func (cfg Config) imageSettings() imageSettings {
+	settings := imageSettings{
+		Width:      cfg.ImageWidth,
+		Format:     cfg.ImageFormat,
+		Quality:    cfg.ImageQuality,
+		Filter:     cfg.ImageFilter,
+		Background: cfg.FlattenBackground,
+	}
+	if cfg.ImageFormat == "png" {
+		settings.PNGCompression = cfg.PNGCompression
+		settings.PNGColors = cfg.PNGColors
+	}
+	return settings
+}
+
+// configValue is a setting as printed by the config command.
+type configValue struct {
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+	Source string          `json:"source"`
+}
+
+// runConfig prints the settings a build would use, the defaults merged with
+// bricksling.json, and where each comes from, without building.
+func runConfig(args []string) error {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the settings as a JSON config")
+	flags.Parse(args)
+
+	path := "bricksling.json"
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	if *asJSON {
+		output, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+
+	values, unknown, err := configSources(cfg, path)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", value.Key, value.Value, value.Source)
+	}
+	for _, key := range unknown {
+		fmt.Fprintf(w, "%s\t\t%s, unknown key ignored\n", key, path)
+	}
+	return w.Flush()
+}
+
+// configSources returns every setting of cfg in the order of Config, marked
+// as coming from the file at path when it sets the key and from the
+// defaults otherwise, along with the keys of the file that aren't settings.
+// Keys match regardless of case, as they do when the file is loaded.
+func configSources(cfg Config, path string) ([]configValue, []string, error) {
+	fileKeys := make(map[string]json.RawMessage)
+	byteValue, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(byteValue, &fileKeys)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	var values []configValue
+	known := make(map[string]bool)
+	cfgType := reflect.TypeOf(cfg)
+	for i := range cfgType.NumField() {
+		key, _, _ := strings.Cut(cfgType.Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		value, err := json.Marshal(reflect.ValueOf(cfg).Field(i).Interface())
+		if err != nil {
+			return nil, nil, err
+		}
+		source := "default"
+		for fileKey := range fileKeys {
+			if strings.EqualFold(fileKey, key) {
+				source = path
+			}
+		}
+		known[strings.ToLower(key)] = true
+		values = append(values, configValue{Key: key, Value: value, Source: source})
+	}
+
+	var unknown []string
+	for key := range fileKeys {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return values, unknown, nil
+}
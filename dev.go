@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveReloadScript is injected into the HTML pages served by dev. It reloads
+// the page after each successful build and shows a banner when one fails.
+const liveReloadScript = `<script>
+(function () {
+  var events = new EventSource("/__reload");
+  events.addEventListener("reload", function () { location.reload(); });
+  events.addEventListener("failed", function (e) {
+    var banner = document.getElementById("__bricksling_error");
+    if (!banner) {
+      banner = document.createElement("pre");
+      banner.id = "__bricksling_error";
+      banner.style.cssText = "position:fixed;top:0;left:0;right:0;margin:0;padding:1em;" +
+        "background:#b00020;color:#fff;font:14px monospace;white-space:pre-wrap;z-index:2147483647";
+      document.body.appendChild(banner);
+    }
+    banner.textContent = "Build failed: " + JSON.parse(e.data);
+  });
+})();
+</script>
+`
+
+// devStatus is the state of the dev server, as reported by /__status.
+type devStatus struct {
+	Builds     int          `json:"builds"`
+	LastBuild  time.Time    `json:"lastBuild"`
+	DurationMs int64        `json:"durationMs"`
+	OK         bool         `json:"ok"`
+	Error      string       `json:"error,omitempty"`
+	Report     *buildReport `json:"report"`
+}
+
+// devServer serves the site while it is being worked on. Pages are served
+// from a copy taken after the last successful build, so a failed build
+// leaves the last good pages in place.
+type devServer struct {
+	outputDir string
+
+	mu     sync.Mutex
+	status devStatus
+	pages  map[string][]byte
+	// changed is closed and replaced after every build, waking up the live
+	// reload connections.
+	changed chan struct{}
+}
+
+// runDev builds the site, serves it with live reload and rebuilds it when
+// sources change.
+func runDev(args []string) error {
+	var opts buildOptions
+	flags := flag.NewFlagSet("dev", flag.ExitOnError)
+	addBuildFlags(flags, &opts)
+	addr := flags.String("addr", ":8080", "address to serve on")
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	dev := &devServer{
+		outputDir: cfg.outputProfiles()[0].OutputDir,
+		changed:   make(chan struct{}),
+	}
+	dev.build(cfg, opts)
+
+	paths := watchedPaths(cfg, "all")
+	fmt.Printf("Watching %s for changes...\n", strings.Join(paths, ", "))
+	go watchChanges(paths, func(changed []string) {
+		fmt.Printf("Changed %s, rebuilding...\n", strings.Join(changed, ", "))
+		dev.build(cfg, rebuildOptions(opts, "all", changed))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__status", dev.serveStatus)
+	mux.HandleFunc("/__reload", dev.serveReload)
+	mux.HandleFunc("/", dev.servePage)
+
+	log.Printf("Dev server starting at %s", *addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+// build builds the site and records the outcome, keeping the pages of the
+// last successful build when it fails.
+func (d *devServer) build(cfg Config, opts buildOptions) {
+	start := time.Now()
+	report, err := build(cfg, opts)
+	if err != nil {
+		fmt.Printf("Build failed: %v\n", err)
+	}
+
+	var pages map[string][]byte
+	if err == nil {
+		pages = readPages(d.outputDir)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.Builds++
+	d.status.LastBuild = start
+	d.status.DurationMs = time.Since(start).Milliseconds()
+	d.status.OK = err == nil
+	d.status.Error = ""
+	if err != nil {
+		d.status.Error = err.Error()
+	}
+	d.status.Report = report
+	if pages != nil {
+		d.pages = pages
+	}
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// readPages reads every file of the output directory but the images, which
+// builds only ever replace whole.
+func readPages(outputDir string) map[string][]byte {
+	pages := make(map[string][]byte)
+	filepath.WalkDir(outputDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(outputDir, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == "images" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if contents, err := os.ReadFile(p); err == nil {
+			pages[rel] = contents
+		}
+		return nil
+	})
+	return pages
+}
+
+// servePage serves a page of the last successful build, with the live reload
+// script added to HTML, and anything else from the output directory.
+func (d *devServer) servePage(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	d.mu.Lock()
+	contents, ok := d.pages[name]
+	d.mu.Unlock()
+	if !ok {
+		http.FileServer(http.Dir(d.outputDir)).ServeHTTP(w, r)
+		return
+	}
+
+	if strings.HasSuffix(name, ".html") {
+		contents = injectLiveReload(contents)
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(contents)
+}
+
+// injectLiveReload adds the live reload script to the end of an HTML page.
+func injectLiveReload(page []byte) []byte {
+	i := bytes.LastIndex(page, []byte("</body>"))
+	if i < 0 {
+		return append(page[:len(page):len(page)], liveReloadScript...)
+	}
+	injected := make([]byte, 0, len(page)+len(liveReloadScript))
+	injected = append(injected, page[:i]...)
+	injected = append(injected, liveReloadScript...)
+	return append(injected, page[i:]...)
+}
+
+// serveStatus reports the last build as JSON.
+func (d *devServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	output, err := json.MarshalIndent(d.status, "", "  ")
+	d.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(output)
+}
+
+// serveReload streams server-sent events to the live reload script: reload
+// after a successful build, and failed with the error after a failed one,
+// also sent right away when the last build failed.
+func (d *devServer) serveReload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	d.mu.Lock()
+	changed, status := d.changed, d.status
+	d.mu.Unlock()
+	if !status.OK {
+		writeFailedEvent(w, status.Error)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		}
+
+		d.mu.Lock()
+		changed, status = d.changed, d.status
+		d.mu.Unlock()
+		if status.OK {
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+		} else {
+			writeFailedEvent(w, status.Error)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeFailedEvent(w http.ResponseWriter, message string) {
+	data, _ := json.Marshal(message)
+	fmt.Fprintf(w, "event: failed\ndata: %s\n\n", data)
+}
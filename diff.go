@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffLine is a single line of an edit script: ' ' kept, '-' removed or
+// '+' added.
+type diffLine struct {
+	Op   byte
+	Text string
+}
+
+// maxDiffCells bounds the LCS table; larger changes are shown as a
+// replacement of the whole changed region.
+const maxDiffCells = 4_000_000
+
+// unifiedDiff returns a unified diff between the texts a and b with three
+// lines of context, or an empty string when they are equal.
+func unifiedDiff(aName string, bName string, a string, b string) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	const context = 3
+	for i := 0; i < len(lines); {
+		if lines[i].Op == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk until the changes are more than two contexts apart.
+		start := max(i-context, 0)
+		end := i
+		for j := i; j < len(lines) && j <= end+2*context; j++ {
+			if lines[j].Op != ' ' {
+				end = j
+			}
+		}
+		end = min(end+context+1, len(lines))
+
+		aStart, bStart := 1, 1
+		for _, line := range lines[:start] {
+			if line.Op != '+' {
+				aStart++
+			}
+			if line.Op != '-' {
+				bStart++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, line := range lines[start:end] {
+			if line.Op != '+' {
+				aLen++
+			}
+			if line.Op != '-' {
+				bLen++
+			}
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, line := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", line.Op, line.Text)
+		}
+		i = end
+	}
+
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines returns the edit script turning a into b.
+func diffLines(a []string, b []string) []diffLine {
+	// Common prefix and suffix are kept as they are.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	return lines
+}
+
+// diffMiddle diffs the changed region using the longest common subsequence.
+func diffMiddle(a []string, b []string) []diffLine {
+	var lines []diffLine
+	if len(a)*len(b) > maxDiffCells {
+		for _, text := range a {
+			lines = append(lines, diffLine{'-', text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{'+', text})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary,omitempty"`
+}
+
+// jsonFeed is a JSON Feed, https://www.jsonfeed.org/version/1.1/.
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Title         string `json:"title"`
+	ContentText   string `json:"content_text"`
+	Image         string `json:"image,omitempty"`
+	DatePublished string `json:"date_published,omitempty"`
+	DateModified  string `json:"date_modified,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// feedLink returns the link of a post in feeds: its page when it has one,
+// or else home.
+func feedLink(baseURL string, home string, post Post) string {
+	if post.URL == "" {
+		return home
+	}
+	return absoluteURL(baseURL, post.URL)
+}
+
+// feedIDs returns the ids of the posts in feeds: the URL of their page, or
+// else the site URL with a fragment of their date and slug. They do not depend
+// on the image, so posts without one or sharing one still get their own.
+func feedIDs(baseURL string, posts []Post) []string {
+	ids := make([]string, len(posts))
+	taken := make(map[string]bool)
+	for i, post := range posts {
+		if post.URL != "" {
+			ids[i] = absoluteURL(baseURL, post.URL)
+			continue
+		}
+		slug := slugify(post.Title)
+		if slug == "" {
+			slug = "post"
+		}
+		if !post.PublishedAt.IsZero() {
+			slug = post.PublishedAt.Format("2006-01-02") + "-" + slug
+		}
+		name := slug
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", slug, n)
+		}
+		taken[name] = true
+		ids[i] = absoluteURL(baseURL, "/#"+name)
+	}
+	return ids
+}
+
+// writeRSSFeed writes an RSS 2.0 feed of the posts to path. Without posts the
+// feed is a valid channel with no items.
+func writeRSSFeed(path string, cfg Config, posts []Post) error {
+	channel := rssChannel{
+		Title:       cfg.Title,
+		Link:        absoluteURL(cfg.BaseURL, "/"),
+		Description: cfg.Description,
+	}
+	if channel.Title == "" {
+		channel.Title = channel.Link
+	}
+	if channel.Description == "" {
+		channel.Description = channel.Title
+	}
+
+	ids := feedIDs(cfg.BaseURL, posts)
+	for i, post := range posts {
+		item := rssItem{
+			Title:       post.Title,
+			Link:        feedLink(cfg.BaseURL, channel.Link, post),
+			Description: post.Caption,
+			GUID:        rssGUID{IsPermaLink: post.URL != "", Value: ids[i]},
+		}
+		if !post.PublishedAt.IsZero() {
+			item.PubDate = post.PublishedAt.Format(time.RFC1123Z)
+		}
+		channel.Items = append(channel.Items, item)
+	}
+
+	return writeXML(path, rssFeed{Version: "2.0", Channel: channel})
+}
+
+// writeAtomFeed writes an Atom feed of the posts to path. Entries are updated
+// when the post was published, or else when it last changed, and a feed
+// without entries when it is written.
+func writeAtomFeed(path string, cfg Config, posts []Post) error {
+	link := absoluteURL(cfg.BaseURL, "/")
+	feed := atomFeed{
+		Title:  cfg.Title,
+		ID:     link,
+		Link:   atomLink{Href: link},
+		Author: atomAuthor{Name: cfg.Author},
+	}
+	if feed.Title == "" {
+		feed.Title = link
+	}
+	if feed.Author.Name == "" {
+		feed.Author.Name = feed.Title
+	}
+
+	ids := feedIDs(cfg.BaseURL, posts)
+	var updated time.Time
+	for i, post := range posts {
+		postUpdated := post.ModTime.UTC()
+		if !post.PublishedAt.IsZero() {
+			postUpdated = post.PublishedAt
+		}
+		if postUpdated.After(updated) {
+			updated = postUpdated
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   post.Title,
+			ID:      ids[i],
+			Link:    atomLink{Href: feedLink(cfg.BaseURL, link, post)},
+			Updated: postUpdated.Format(time.RFC3339),
+			Summary: post.Caption,
+		})
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	return writeXML(path, feed)
+}
+
+// writeJSONFeed writes a JSON Feed of the posts to path.
+func writeJSONFeed(path string, cfg Config, posts []Post) error {
+	link := absoluteURL(cfg.BaseURL, "/")
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       cfg.Title,
+		HomePageURL: link,
+		FeedURL:     absoluteURL(cfg.BaseURL, "/feed.json"),
+		Description: cfg.Description,
+		Items:       make([]jsonFeedItem, 0, len(posts)),
+	}
+	if feed.Title == "" {
+		feed.Title = link
+	}
+
+	ids := feedIDs(cfg.BaseURL, posts)
+	for i, post := range posts {
+		item := jsonFeedItem{
+			ID:          ids[i],
+			URL:         feedLink(cfg.BaseURL, link, post),
+			Title:       post.Title,
+			ContentText: post.Caption,
+		}
+		if post.ImageURL != "" {
+			item.Image = absoluteURL(cfg.BaseURL, post.ImageURL)
+		}
+		if !post.PublishedAt.IsZero() {
+			item.DatePublished = post.PublishedAt.Format(time.RFC3339)
+		}
+		if !post.ModTime.IsZero() {
+			item.DateModified = post.ModTime.UTC().Format(time.RFC3339)
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	output, err := json.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(output, '\n'), 0644)
+}
+
+// writeRobotsTxt writes a robots.txt allowing everything and pointing to the
+// sitemap.
+func writeRobotsTxt(path string, baseURL string) error {
+	robots := "User-agent: *\nAllow: /\n\nSitemap: " + absoluteURL(baseURL, "/sitemap.xml") + "\n"
+	return os.WriteFile(path, []byte(robots), 0644)
+}
+
+// writeMeta writes the feeds, the sitemap listing pageURLs and robots.txt
+// into outputDir. They all need absolute URLs, so nothing is written when
+// baseURL is not set.
+func writeMeta(cfg Config, outputDir string, posts []Post, pageURLs []string) error {
+	if cfg.BaseURL == "" {
+		fmt.Println("Skipping feeds and sitemap, baseURL is not set.")
+		return nil
+	}
+
+	err := writeRSSFeed(filepath.Join(outputDir, "feed.xml"), cfg, posts)
+	if err != nil {
+		return fmt.Errorf("error writing feed: %w", err)
+	}
+	err = writeAtomFeed(filepath.Join(outputDir, "atom.xml"), cfg, posts)
+	if err != nil {
+		return fmt.Errorf("error writing Atom feed: %w", err)
+	}
+	err = writeJSONFeed(filepath.Join(outputDir, "feed.json"), cfg, posts)
+	if err != nil {
+		return fmt.Errorf("error writing JSON feed: %w", err)
+	}
+	err = writeSitemap(filepath.Join(outputDir, "sitemap.xml"), cfg.BaseURL, pageURLs)
+	if err != nil {
+		return fmt.Errorf("error writing sitemap: %w", err)
+	}
+	err = writeRobotsTxt(filepath.Join(outputDir, "robots.txt"), cfg.BaseURL)
+	if err != nil {
+		return fmt.Errorf("error writing robots.txt: %w", err)
+	}
+	return nil
+}
+
+// writeSitemap writes a sitemap listing the root relative page URLs. The index
+// is always listed, even when there are no posts.
+func writeSitemap(path string, baseURL string, pageURLs []string) error {
+	urlSet := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	seen := make(map[string]bool)
+	for _, pageURL := range append([]string{"/"}, pageURLs...) {
+		if seen[pageURL] {
+			continue
+		}
+		seen[pageURL] = true
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: absoluteURL(baseURL, pageURL)})
+	}
+
+	return writeXML(path, urlSet)
+}
+
+func writeXML(path string, v any) error {
+	output, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(output, '\n')...), 0644)
+}
+
+// latestPost is a post in latest.json.
+type latestPost struct {
+	Title   string `json:"title"`
+	Caption string `json:"caption"`
+	Image   string `json:"image"`
+	Date    string `json:"date,omitempty"`
+}
+
+// writeLatestJSON writes the cfg.LatestCount newest posts to path for
+// JavaScript widgets. Image URLs are absolute when baseURL is set.
+func writeLatestJSON(path string, cfg Config, posts []Post) error {
+	latest := struct {
+		Posts []latestPost `json:"posts"`
+	}{Posts: make([]latestPost, 0, cfg.LatestCount)}
+
+	for _, post := range sortedByDate(posts, cfg.location()) {
+		if len(latest.Posts) == cfg.LatestCount {
+			break
+		}
+		imageURL := post.ImageURL
+		if cfg.BaseURL != "" && imageURL != "" {
+			imageURL = absoluteURL(cfg.BaseURL, imageURL)
+		}
+		latest.Posts = append(latest.Posts, latestPost{
+			Title:   post.Title,
+			Caption: post.Caption,
+			Image:   imageURL,
+			Date:    post.Date,
+		})
+	}
+
+	output, err := json.MarshalIndent(latest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(output, '\n'), 0644)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFeedIDsAreUnique(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	posts := []Post{
+		{Title: "Sunset", ImageURL: "/images/a.jpg", PublishedAt: day},
+		{Title: "Sunset", ImageURL: "/images/a.jpg", PublishedAt: day},
+		{Title: "No image"},
+		{Title: "Page", ImageURL: "/images/a.jpg", URL: "/posts/page/"},
+	}
+	want := []string{
+		"https://example.com/#2024-05-01-sunset",
+		"https://example.com/#2024-05-01-sunset-2",
+		"https://example.com/#no-image",
+		"https://example.com/posts/page/",
+	}
+	if ids := feedIDs("https://example.com", posts); !slices.Equal(ids, want) {
+		t.Errorf("ids are %v, want %v", ids, want)
+	}
+}
+
+func TestFeedsLinkToPostPages(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://example.com"
+	posts := []Post{{Title: "Page", URL: "/posts/page/"}, {Title: "No page"}}
+	want := []string{"https://example.com/posts/page/", "https://example.com/"}
+
+	if err := writeRSSFeed(filepath.Join(dir, "feed.xml"), cfg, posts); err != nil {
+		t.Fatal(err)
+	}
+	var rss struct {
+		Links []string `xml:"channel>item>link"`
+	}
+	if err := xml.Unmarshal([]byte(readTestFile(t, filepath.Join(dir, "feed.xml"))), &rss); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rss.Links, want) {
+		t.Errorf("RSS links are %v, want %v", rss.Links, want)
+	}
+
+	if err := writeAtomFeed(filepath.Join(dir, "atom.xml"), cfg, posts); err != nil {
+		t.Fatal(err)
+	}
+	var atom struct {
+		Entries []struct {
+			Link struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal([]byte(readTestFile(t, filepath.Join(dir, "atom.xml"))), &atom); err != nil {
+		t.Fatal(err)
+	}
+	var atomLinks []string
+	for _, entry := range atom.Entries {
+		atomLinks = append(atomLinks, entry.Link.Href)
+	}
+	if !slices.Equal(atomLinks, want) {
+		t.Errorf("Atom links are %v, want %v", atomLinks, want)
+	}
+
+	if err := writeJSONFeed(filepath.Join(dir, "feed.json"), cfg, posts); err != nil {
+		t.Fatal(err)
+	}
+	var feed struct {
+		Items []struct {
+			URL string `json:"url"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(readTestFile(t, filepath.Join(dir, "feed.json"))), &feed); err != nil {
+		t.Fatal(err)
+	}
+	var jsonLinks []string
+	for _, item := range feed.Items {
+		jsonLinks = append(jsonLinks, item.URL)
+	}
+	if !slices.Equal(jsonLinks, want) {
+		t.Errorf("JSON Feed links are %v, want %v", jsonLinks, want)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// runPostBuild runs the post build command through the shell, streaming its
+// output. The output directory is passed as $1 and in BRICKSLING_OUTPUT_DIR.
+func runPostBuild(command string, outputDir string) error {
+	fmt.Printf("Running post build command: %s\n", command)
+
+	cmd := exec.Command("sh", "-c", command, "sh", outputDir)
+	cmd.Env = append(os.Environ(), "BRICKSLING_OUTPUT_DIR="+outputDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,1387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// imageSettings are the settings an output image is encoded with.
+type imageSettings struct {
+	Width   int    `json:"width"`
+	Format  string `json:"format"`
+	Quality int    `json:"quality"`
+	Filter  string `json:"filter"`
+	// Background is the color transparent images are flattened onto when
+	// encoded to an opaque format.
+	Background string `json:"background"`
+	// PNGCompression and PNGColors are the PNG compression level and palette
+	// size, only set for PNG output.
+	PNGCompression string `json:"pngCompression,omitempty"`
+	PNGColors      int    `json:"pngColors,omitempty"`
+	// Square crops the image to a centered square before resizing it.
+	Square bool `json:"square,omitempty"`
+	// Copy copies the source verbatim, ignoring every other setting.
+	Copy bool `json:"copy,omitempty"`
+}
+
+// imageCacheEntry records the source and settings an output image was
+// produced from.
+type imageCacheEntry struct {
+	Hash string `json:"hash"`
+	imageSettings
+}
+
+// imageCache remembers how every output image was produced, so an image is
+// only encoded again when its source or its settings change.
+type imageCache struct {
+	path   string
+	mu     sync.Mutex
+	Images map[string]imageCacheEntry `json:"images"`
+	// Inlined holds the main images inlined into pages whose file is not
+	// written, by name, as nothing links to them.
+	Inlined map[string]inlinedImage `json:"inlined,omitempty"`
+}
+
+// inlinedImage is an inlined image without a file: its data URI and size.
+type inlinedImage struct {
+	DataURL template.URL `json:"dataURL"`
+	Width   int          `json:"width"`
+	Height  int          `json:"height"`
+}
+
+var resizeFilters = map[string]resize.InterpolationFunction{
+	"nearest":           resize.NearestNeighbor,
+	"bilinear":          resize.Bilinear,
+	"bicubic":           resize.Bicubic,
+	"mitchellnetravali": resize.MitchellNetravali,
+	"lanczos2":          resize.Lanczos2,
+	"lanczos3":          resize.Lanczos3,
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+var imageExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+}
+
+// loadImageCache reads the cache at path. A missing or unreadable cache is
+// treated as empty, which makes every image to be encoded again.
+func loadImageCache(path string) *imageCache {
+	cache := &imageCache{path: path, Images: make(map[string]imageCacheEntry)}
+
+	byteValue, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(byteValue, cache); err != nil {
+		fmt.Printf("Ignoring unreadable image cache %s: %v\n", path, err)
+		cache.Images = make(map[string]imageCacheEntry)
+	}
+	if cache.Images == nil {
+		cache.Images = make(map[string]imageCacheEntry)
+	}
+
+	return cache
+}
+
+// upToDate reports whether the output image at dstPath exists, or is inlined
+// without a file, and was produced from the same source and settings as
+// entry.
+func (c *imageCache) upToDate(name string, dstPath string, entry imageCacheEntry) bool {
+	_, err := os.Stat(dstPath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, inlined := c.Inlined[name]; err != nil && !inlined {
+		return false
+	}
+	return c.Images[name] == entry
+}
+
+// inlinedImage returns the inlined image recorded for the output name, if
+// any.
+func (c *imageCache) inlinedImage(name string) (inlinedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	image, ok := c.Inlined[name]
+	return image, ok
+}
+
+// set records how the output image name was produced.
+func (c *imageCache) set(name string, entry imageCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Images[name] = entry
+}
+
+// allSameSettings reports whether every output exists under dir and was
+// encoded with its current settings, regardless of the source.
+func (c *imageCache) allSameSettings(dir string, outputs []imageOutput) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, output := range outputs {
+		if _, err := os.Stat(filepath.Join(dir, output.Name)); err != nil {
+			return false
+		}
+		entry, ok := c.Images[output.Name]
+		if !ok || entry.imageSettings != output.Settings {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *imageCache) save() error {
+	cacheJSON, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, cacheJSON, 0644)
+}
+
+// outputImageName returns the file name a source image is written to in the
+// given format.
+func outputImageName(image string, format string) string {
+	name := filepath.Base(image)
+	return strings.TrimSuffix(name, filepath.Ext(name)) + imageExtensions[format]
+}
+
+// fileLimiter caps the number of files the image pipeline keeps open at
+// once. A nil limiter doesn't limit anything.
+type fileLimiter chan struct{}
+
+func newFileLimiter(n int) fileLimiter {
+	return make(fileLimiter, n)
+}
+
+// acquire waits for a free slot and returns the function releasing it.
+func (l fileLimiter) acquire() func() {
+	if l == nil {
+		return func() {}
+	}
+	l <- struct{}{}
+	return func() { <-l }
+}
+
+// isOpaque reports whether img is known to have no transparent pixels.
+func isOpaque(img image.Image) bool {
+	opaque, ok := img.(interface{ Opaque() bool })
+	return ok && opaque.Opaque()
+}
+
+// flatten composites img over a solid background color.
+func flatten(img image.Image, background color.Color) image.Image {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+// parseHexColor parses a "#rrggbb" or "#rgb" color.
+func parseHexColor(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 0xff}
+	var err error
+	switch len(s) {
+	case 7:
+		_, err = fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+	case 4:
+		_, err = fmt.Sscanf(s, "#%1x%1x%1x", &c.R, &c.G, &c.B)
+		c.R *= 0x11
+		c.G *= 0x11
+		c.B *= 0x11
+	default:
+		err = fmt.Errorf("invalid color %q, expected #rrggbb or #rgb", s)
+	}
+	if err != nil {
+		return c, fmt.Errorf("invalid color %q, expected #rrggbb or #rgb", s)
+	}
+	return c, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of the file contents.
+func hashFile(path string, limit fileLimiter) (string, error) {
+	defer limit.acquire()()
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// imageOutput is a single file generated from a source image.
+type imageOutput struct {
+	// Name is the path of the file relative to the images output directory.
+	Name     string
+	Settings imageSettings
+	// Density is the pixel density of a responsive variant with density
+	// descriptors, like 2 for 2x.
+	Density float64
+}
+
+// ImageVariant is a responsive variant of a post image. Density is its pixel
+// density with density descriptors, zero with width descriptors.
+type ImageVariant struct {
+	Width   int
+	URL     string
+	Density float64
+}
+
+// imageOverrides are per image settings given as a query suffix on the image
+// path, like "pano.jpg?w=2400&q=90". Zero values keep the configured setting.
+type imageOverrides struct {
+	Width   int
+	Quality int
+}
+
+// splitImageRef splits an image reference from the JSON data into the path of
+// the image and its overrides. Unknown or invalid parameters are ignored.
+func splitImageRef(ref string) (string, imageOverrides) {
+	var overrides imageOverrides
+	path, query, ok := strings.Cut(ref, "?")
+	if !ok || isRemoteImage(ref) {
+		return ref, overrides
+	}
+
+	values, _ := url.ParseQuery(query)
+	if width, err := strconv.Atoi(values.Get("w")); err == nil && width > 0 {
+		overrides.Width = width
+	}
+	if quality, err := strconv.Atoi(values.Get("q")); err == nil && quality >= 1 && quality <= 100 {
+		overrides.Quality = quality
+	}
+	return path, overrides
+}
+
+// imageSource is a local source image along with the overrides its outputs
+// are built with. References spelling the same overrides differently are the
+// same source.
+type imageSource struct {
+	Path string
+	imageOverrides
+}
+
+// newImageSource returns the source of a local image reference.
+func newImageSource(ref string) imageSource {
+	path, overrides := splitImageRef(ref)
+	return imageSource{Path: path, imageOverrides: overrides}
+}
+
+// String returns the source as an image reference, like "pano.jpg?w=2400".
+func (src imageSource) String() string {
+	var params []string
+	if src.Width != 0 {
+		params = append(params, fmt.Sprintf("w=%d", src.Width))
+	}
+	if src.Quality != 0 {
+		params = append(params, fmt.Sprintf("q=%d", src.Quality))
+	}
+	if len(params) == 0 {
+		return src.Path
+	}
+	return src.Path + "?" + strings.Join(params, "&")
+}
+
+// name returns the name the outputs of the source are named after by
+// default: its path with a suffix per override, like "pano-w2400-q90.jpg",
+// so that the same image with other overrides gets outputs of its own.
+func (src imageSource) name() string {
+	ext := filepath.Ext(src.Path)
+	name := strings.TrimSuffix(src.Path, ext)
+	if src.Width != 0 {
+		name += fmt.Sprintf("-w%d", src.Width)
+	}
+	if src.Quality != 0 {
+		name += fmt.Sprintf("-q%d", src.Quality)
+	}
+	return name + ext
+}
+
+// imageSource returns the source the image reference of the post is built
+// from. The quality of the post applies unless the reference has its own.
+func (post Post) imageSource(ref string) imageSource {
+	src := newImageSource(ref)
+	if src.Quality == 0 && !isRemoteImage(ref) {
+		src.Quality = post.Quality
+	}
+	return src
+}
+
+// imagePath returns the path of an image reference without its overrides.
+func imagePath(ref string) string {
+	path, _ := splitImageRef(ref)
+	return path
+}
+
+// imageOutputs returns the files generated from a source image: the main
+// image followed by a variant per responsive width or density and the square
+// thumbnail when asked for. The files are named after name, see outputNames.
+// A width override applies to the main image and a quality override to every
+// output.
+func imageOutputs(src imageSource, name string, thumbnail bool, cfg Config) []imageOutput {
+	image, overrides := src.Path, src.imageOverrides
+	if cfg.ProcessImages == "copy" {
+		copyName := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)) + filepath.Ext(image)
+		return []imageOutput{{Name: copyName, Settings: imageSettings{Copy: true}}}
+	}
+
+	settings := cfg.imageSettings()
+	if overrides.Quality != 0 {
+		settings.Quality = overrides.Quality
+	}
+	main := settings
+	if overrides.Width != 0 {
+		main.Width = overrides.Width
+	}
+	outputs := []imageOutput{{Name: outputImageName(name, settings.Format), Settings: main}}
+	var widths []int
+	for _, width := range cfg.ResponsiveWidths {
+		// A width override can make the main image one of the widths.
+		if width == main.Width || slices.Contains(widths, width) {
+			continue
+		}
+		widths = append(widths, width)
+		variant := settings
+		variant.Width = width
+		outputs = append(outputs, imageOutput{
+			Name:     variantImageName(name, settings.Format, width, cfg.ImageLayout),
+			Settings: variant,
+		})
+	}
+	for _, density := range cfg.densities() {
+		variant := settings
+		variant.Width = int(math.Round(float64(main.Width) * density))
+		outputs = append(outputs, imageOutput{
+			Name:     variantImageName(name, settings.Format, variant.Width, cfg.ImageLayout),
+			Settings: variant,
+			Density:  density,
+		})
+	}
+	if thumbnail && cfg.ThumbnailSize > 0 {
+		square := settings
+		square.Width = cfg.ThumbnailSize
+		square.Square = true
+		outputs = append(outputs, imageOutput{
+			Name:     thumbnailImageName(name, settings.Format),
+			Settings: square,
+		})
+	}
+	if cfg.KeepOriginalGIF && isGIF(image) {
+		outputs = append(outputs, imageOutput{
+			Name:     strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)) + ".gif",
+			Settings: imageSettings{Copy: true},
+		})
+	}
+	return outputs
+}
+
+// isGIF reports whether the image at path is a GIF, by its extension.
+func isGIF(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gif")
+}
+
+// variantImageName returns the file name of a responsive variant, either
+// "name-480.jpg" in the flat layout or "480/name.jpg" in the dirs layout.
+func variantImageName(image string, format string, width int, layout string) string {
+	name := outputImageName(image, format)
+	if layout == "dirs" {
+		return fmt.Sprintf("%d/%s", width, name)
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), width, ext)
+}
+
+// thumbnailImageName returns the file name of a square thumbnail,
+// "name-thumb.jpg".
+func thumbnailImageName(image string, format string) string {
+	name := outputImageName(image, format)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-thumb" + ext
+}
+
+// thumbnailSources returns the images thumbnails are generated for: the main
+// images of the posts asking for one with "thumbnail": true, and when the
+// templates use thumbnails, of every post not opting out.
+func thumbnailSources(posts []Post, templatesUse bool) map[imageSource]bool {
+	sources := make(map[imageSource]bool)
+	for _, post := range posts {
+		wanted := templatesUse
+		if post.Thumbnail != nil {
+			wanted = *post.Thumbnail
+		}
+		if wanted && post.Image != "" && !isRemoteImage(post.Image) {
+			sources[post.imageSource(post.Image)] = true
+		}
+	}
+	return sources
+}
+
+// templatesUseThumbnails reports whether any of the templates at paths reads
+// .ThumbnailURL, see templatesUseField.
+func templatesUseThumbnails(paths ...string) bool {
+	return templatesUseField([]string{"ThumbnailURL"}, paths...)
+}
+
+// outputNames returns the name the outputs of every local image source are
+// named after. By default that is the source path with its overrides, see
+// imageSource.name, so images keep their file name. Outputs are written
+// without the directory of the source, so the second "a.jpg" of different
+// directories gets "a-2.jpg", in the order of the posts. With slug naming the
+// images of a post are named after its title, "my-post" for the first and
+// "my-post-2" and on for the others, followed by a number when taken. An
+// image used by several posts is named after the first one.
+func outputNames(posts []Post, cfg Config) map[imageSource]string {
+	names := make(map[imageSource]string)
+	taken := make(map[string]bool)
+	for _, post := range posts {
+		slug := slugify(post.Title)
+		for _, ref := range post.sources() {
+			if isRemoteImage(ref) {
+				continue
+			}
+			src := post.imageSource(ref)
+			if _, ok := names[src]; ok {
+				continue
+			}
+			if cfg.ImageNaming != "slug" || slug == "" {
+				names[src] = uniqueBaseName(src.name(), taken)
+				continue
+			}
+
+			name := slug
+			for n := 2; taken[name]; n++ {
+				name = fmt.Sprintf("%s-%d", slug, n)
+			}
+			taken[name] = true
+			names[src] = name
+		}
+	}
+	return names
+}
+
+// uniqueBaseName returns the name with a number after its file name when
+// that is taken, ignoring the directory and extension, and takes it.
+func uniqueBaseName(name string, taken map[string]bool) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(filepath.Base(name), ext)
+	unique := stem
+	for n := 2; taken[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", stem, n)
+	}
+	taken[unique] = true
+	if unique == stem {
+		return name
+	}
+	return unique + ext
+}
+
+// buildImages resizes the image of every post into outputDir/images, skipping
+// the ones that are up to date, and sets the URLs and size of the generated
+// images on the posts. Files in the images output directory that no post
+// produces any more are removed, except for the variants optimize wrote of
+// the images that are unchanged.
+//
+// When scope is not nil only the images in it are checked against their
+// source; the others are trusted to be up to date as long as they exist and
+// were encoded with the same settings.
+//
+// Unless writeInlined is set, the main images inlined into pages as data URIs
+// are not kept as files, see removeInlinedFiles.
+func buildImages(posts []Post, cfg Config, imagesPath string, outputDir string, scope map[string]bool, thumbnails map[imageSource]bool, writeInlined bool, report *buildReport) {
+	imagesOutputDir := filepath.Join(outputDir, "images")
+
+	// Create the images output directory if it doesn't exist
+	if _, err := os.Stat(imagesOutputDir); os.IsNotExist(err) {
+		os.MkdirAll(imagesOutputDir, os.ModePerm)
+	}
+	if err := removeTempImages(imagesOutputDir); err != nil {
+		fmt.Printf("Error removing unfinished images: %v\n", err)
+	}
+
+	b := &imageBuilder{
+		cfg:        cfg,
+		imagesPath: imagesPath,
+		outputDir:  imagesOutputDir,
+		scope:      scope,
+		cache:      loadImageCache(filepath.Join(outputDir, ".image-cache.json")),
+		produced:   make(map[string]bool),
+		limit:      newFileLimiter(cfg.MaxOpenFiles),
+		report:     report,
+		names:      outputNames(posts, cfg),
+		thumbnails: thumbnails,
+	}
+	if writeInlined {
+		// Images inlined by a previous build are written again.
+		b.cache.Inlined = nil
+	}
+
+	// Every source is built once, even when several posts use it.
+	sources := uniqueSources(posts)
+	for _, src := range sources {
+		for _, output := range imageOutputs(src, b.names[src], b.thumbnails[src], cfg) {
+			b.produced[output.Name] = true
+		}
+	}
+
+	results := make([]generatedImage, len(sources))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range cfg.ImageWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = b.build(sources[i])
+			}
+		}()
+	}
+	for i := range sources {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	generated := make(map[imageSource]generatedImage, len(sources))
+	for i, src := range sources {
+		generated[src] = results[i]
+	}
+	inlineImages(generated, imagesOutputDir, cfg.InlineBelowBytes)
+	if !writeInlined {
+		removeInlinedFiles(generated, imagesOutputDir, b.cache)
+	}
+	setGeneratedImages(posts, generated)
+
+	err := keepOptimizedVariants(outputDir, imagesOutputDir, b.produced)
+	if err != nil {
+		fmt.Printf("Error reading the optimized images: %v\n", err)
+	}
+	err = pruneImages(imagesOutputDir, b.produced, b.cache)
+	if err != nil {
+		fmt.Printf("Error removing orphaned images: %v\n", err)
+	}
+
+	err = b.cache.save()
+	if err != nil {
+		fmt.Printf("Error saving image cache: %v\n", err)
+	}
+}
+
+// linkImages sets the URLs and size of the already generated images on the
+// posts without processing any image, for builds that only render pages.
+func linkImages(posts []Post, cfg Config, outputDir string, thumbnails map[imageSource]bool) {
+	imagesOutputDir := filepath.Join(outputDir, "images")
+	cache := loadImageCache(filepath.Join(outputDir, ".image-cache.json"))
+	names := outputNames(posts, cfg)
+	generated := make(map[imageSource]generatedImage)
+	for _, src := range uniqueSources(posts) {
+		outputs := imageOutputs(src, names[src], thumbnails[src], cfg)
+		image := imageURLs(outputs)
+		var err error
+		image.Width, image.Height, err = imageSize(filepath.Join(imagesOutputDir, outputs[0].Name), nil)
+		if inlined, ok := cache.inlinedImage(outputs[0].Name); ok && err != nil {
+			image = withInlined(image, inlined)
+		}
+		generated[src] = image
+	}
+	inlineImages(generated, imagesOutputDir, cfg.InlineBelowBytes)
+	setGeneratedImages(posts, generated)
+}
+
+// verifyImages decodes every image generated for the posts in outputDir,
+// checking that the resized ones have the width they were encoded at, and
+// returns an error listing the ones that failed. Outputs that don't exist
+// were already reported as failing to process and are skipped.
+func verifyImages(posts []Post, cfg Config, outputDir string, thumbnails map[imageSource]bool, report *buildReport) error {
+	imagesOutputDir := filepath.Join(outputDir, "images")
+	names := outputNames(posts, cfg)
+	var failed []string
+	for _, src := range uniqueSources(posts) {
+		for _, output := range imageOutputs(src, names[src], thumbnails[src], cfg) {
+			path := filepath.Join(imagesOutputDir, output.Name)
+			err := verifyImage(path, output.Settings)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Invalid image %s: %v\n", path, err)
+				report.imageFailed(path, err)
+				failed = append(failed, path)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d images failed verification: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// verifyImage decodes the image at path fully and checks its size against
+// the settings it was generated with. Copies only need to decode, when in a
+// format that can be decoded.
+func verifyImage(path string, settings imageSettings) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	img, err := decodeImage(path, nil)
+	if settings.Copy && errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil || settings.Copy {
+		return err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != settings.Width {
+		return fmt.Errorf("width is %d, expected %d", bounds.Dx(), settings.Width)
+	}
+	if settings.Square && bounds.Dy() != settings.Width {
+		return fmt.Errorf("height is %d, expected %d", bounds.Dy(), settings.Width)
+	}
+	return nil
+}
+
+// inlineImages sets a data URI with the contents of the main image as the
+// embed URL of the images smaller than threshold bytes, unless they have one
+// already. A zero threshold inlines nothing.
+func inlineImages(generated map[imageSource]generatedImage, imagesOutputDir string, threshold int64) {
+	if threshold <= 0 {
+		return
+	}
+	for src, image := range generated {
+		if image.EmbedURL != "" {
+			continue
+		}
+		path := filepath.Join(imagesOutputDir, strings.TrimPrefix(image.URL, "/images/"))
+		info, err := os.Stat(path)
+		if err != nil || info.Size() >= threshold {
+			continue
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		image.EmbedURL = dataURL(mime.TypeByExtension(filepath.Ext(path)), contents)
+		generated[src] = image
+	}
+}
+
+// removeInlinedFiles removes the main file of the inlined images without
+// responsive variants, whose srcset would link it, and records them in the
+// cache instead so they are not encoded again.
+func removeInlinedFiles(generated map[imageSource]generatedImage, imagesOutputDir string, cache *imageCache) {
+	inlined := make(map[string]inlinedImage)
+	for _, image := range generated {
+		if image.EmbedURL == "" || image.Srcset != "" {
+			continue
+		}
+		name := strings.TrimPrefix(image.URL, "/images/")
+		err := os.Remove(filepath.Join(imagesOutputDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error removing inlined image: %v\n", err)
+			continue
+		}
+		inlined[name] = inlinedImage{DataURL: image.EmbedURL, Width: image.Width, Height: image.Height}
+	}
+	cache.Inlined = inlined
+}
+
+// withInlined returns image with the size and data URI of its inlined main
+// image.
+func withInlined(image generatedImage, inlined inlinedImage) generatedImage {
+	image.Width, image.Height = inlined.Width, inlined.Height
+	image.EmbedURL = inlined.DataURL
+	return image
+}
+
+// inlinedFilesNeeded reports whether the inlined images must still be written
+// as files, because something links to them: the feeds and JSON-LD of
+// profiles with a base URL, latest.json, the JSON API, or templates reading
+// .ImageURL or .URL, see templatesUseField.
+func inlinedFilesNeeded(cfg Config, templatePaths ...string) bool {
+	if cfg.LatestCount > 0 || cfg.API {
+		return true
+	}
+	for _, profile := range cfg.outputProfiles() {
+		if profile.BaseURL != "" {
+			return true
+		}
+	}
+	return templatesUseField([]string{"ImageURL", "URL"}, templatePaths...)
+}
+
+// uniqueSources returns the local images of all posts, each listed once.
+func uniqueSources(posts []Post) []imageSource {
+	var sources []imageSource
+	for _, post := range posts {
+		for _, ref := range post.sources() {
+			if isRemoteImage(ref) {
+				continue
+			}
+			if src := post.imageSource(ref); !slices.Contains(sources, src) {
+				sources = append(sources, src)
+			}
+		}
+	}
+	return sources
+}
+
+// isRemoteImage reports whether src is a URL rather than a path in
+// source/images. Remote images are referenced as they are.
+func isRemoteImage(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// setGeneratedImages sets the generated image of every post and gallery
+// image from the images generated per source. Remote images keep their URL.
+func setGeneratedImages(posts []Post, generated map[imageSource]generatedImage) {
+	for _, post := range posts {
+		for _, ref := range post.sources() {
+			if isRemoteImage(ref) {
+				generated[post.imageSource(ref)] = generatedImage{URL: ref}
+			}
+		}
+	}
+	for i := range posts {
+		post := &posts[i]
+		if post.Image != "" {
+			image := generated[post.imageSource(post.Image)]
+			post.ImageURL = image.URL
+			post.ImageWidth = image.Width
+			post.ImageHeight = image.Height
+			post.ImageVariants = image.Variants
+			post.ImageSrcset = image.Srcset
+			post.ImageOriginalURL = image.OriginalURL
+			post.ThumbnailURL = image.ThumbnailURL
+			post.ImageEmbedURL = embedURL(image)
+		}
+		for j := range post.Images {
+			postImage := &post.Images[j]
+			image := generated[post.imageSource(postImage.Src)]
+			postImage.URL = image.URL
+			postImage.Width = image.Width
+			postImage.Height = image.Height
+			postImage.Variants = image.Variants
+			postImage.Srcset = image.Srcset
+			postImage.OriginalURL = image.OriginalURL
+			postImage.EmbedURL = embedURL(image)
+		}
+	}
+}
+
+// embedURL returns the URL to embed image with in pages, its data URI when
+// it is inlined.
+func embedURL(image generatedImage) template.URL {
+	if image.EmbedURL != "" {
+		return image.EmbedURL
+	}
+	return imageURL(image.URL)
+}
+
+// withImageSizes returns a copy of posts with the sizes attribute of their
+// images set to sizes.
+func withImageSizes(posts []Post, sizes string) []Post {
+	sized := slices.Clone(posts)
+	for i := range sized {
+		post := &sized[i]
+		post.ImageSizes = sizes
+		post.Images = slices.Clone(post.Images)
+		for j := range post.Images {
+			post.Images[j].Sizes = sizes
+		}
+	}
+	return sized
+}
+
+// ImageAttrs returns the srcset and sizes attributes of the image, or nothing
+// when it has no responsive variants.
+func (p Post) ImageAttrs() template.HTMLAttr {
+	return responsiveAttrs(p.ImageSrcset, p.ImageSizes)
+}
+
+// LoadingAttrs returns the loading and fetchpriority attributes of the image
+// for its position on the page.
+func (p Post) LoadingAttrs() template.HTMLAttr {
+	return loadingAttrs(p.AboveFold)
+}
+
+// withPositions returns a copy of the posts of a page with their index on it,
+// the first aboveFold above the fold.
+func withPositions(posts []Post, aboveFold int) []Post {
+	positioned := slices.Clone(posts)
+	for i := range positioned {
+		positioned[i].Index = i
+		positioned[i].AboveFold = i < aboveFold
+	}
+	return positioned
+}
+
+// Attrs returns the srcset and sizes attributes of the gallery image, or
+// nothing when it has no responsive variants.
+func (img PostImage) Attrs() template.HTMLAttr {
+	return responsiveAttrs(img.Srcset, img.Sizes)
+}
+
+// imageBuilder generates the output images of a build.
+type imageBuilder struct {
+	cfg        Config
+	imagesPath string
+	outputDir  string
+	scope      map[string]bool
+	cache      *imageCache
+	// produced holds the names of every output of the build. It is filled
+	// before the workers start and only read afterwards.
+	produced map[string]bool
+	limit    fileLimiter
+	report   *buildReport
+	// names maps every source to the name of its outputs, and thumbnails
+	// tells the sources getting a thumbnail.
+	names      map[imageSource]string
+	thumbnails map[imageSource]bool
+}
+
+// generatedImage describes the files generated from a source image.
+type generatedImage struct {
+	URL          string
+	Width        int
+	Height       int
+	Variants     []ImageVariant
+	Srcset       string
+	OriginalURL  string
+	ThumbnailURL string
+	// EmbedURL is set to a data URI for images inlined into pages.
+	EmbedURL template.URL
+}
+
+// build generates the outputs of the source image src, unless they are up to
+// date. Errors are reported and leave the image with its URLs but no size.
+// It is safe to call from several goroutines for different sources.
+func (b *imageBuilder) build(src imageSource) generatedImage {
+	srcImagePath := filepath.Join(b.imagesPath, src.Path)
+	outputs := imageOutputs(src, b.names[src], b.thumbnails[src], b.cfg)
+	generated := imageURLs(outputs)
+	mainImagePath := filepath.Join(b.outputDir, outputs[0].Name)
+
+	if b.scope != nil && !b.scope[src.Path] && b.cache.allSameSettings(b.outputDir, outputs) {
+		fmt.Printf("Image %s unchanged, skipping...\n", src)
+		b.report.imageSkipped()
+		generated.Width, generated.Height, _ = imageSize(mainImagePath, b.limit)
+		return generated
+	}
+
+	hash, err := hashFile(srcImagePath, b.limit)
+	if err != nil {
+		fmt.Printf("Error reading source image %s: %v\n", src, err)
+		b.report.imageFailed(src.String(), err)
+		return generated
+	}
+
+	var pending []imageOutput
+	for _, output := range outputs {
+		entry := imageCacheEntry{Hash: hash, imageSettings: output.Settings}
+		if !b.cache.upToDate(output.Name, filepath.Join(b.outputDir, output.Name), entry) {
+			pending = append(pending, output)
+		}
+	}
+
+	if len(pending) == 0 {
+		fmt.Printf("Image %s is up to date, skipping...\n", src)
+		b.report.imageSkipped()
+	} else {
+		err = processImage(srcImagePath, b.outputDir, pending, b.limit, b.report)
+		if err != nil {
+			fmt.Printf("Error processing image %s: %v\n", src, err)
+			b.report.imageFailed(src.String(), err)
+			return generated
+		}
+		for _, output := range pending {
+			b.cache.set(output.Name, imageCacheEntry{Hash: hash, imageSettings: output.Settings})
+			if output.Settings.Copy {
+				fmt.Printf("Copied image to %s\n", filepath.Join(b.outputDir, output.Name))
+			} else {
+				fmt.Printf("Resized image saved to %s\n", filepath.Join(b.outputDir, output.Name))
+			}
+		}
+		b.report.imageProcessed()
+	}
+
+	generated.Width, generated.Height, err = imageSize(mainImagePath, b.limit)
+	if inlined, ok := b.cache.inlinedImage(outputs[0].Name); ok && os.IsNotExist(err) {
+		return withInlined(generated, inlined)
+	}
+	if err != nil {
+		b.report.warn("can't read the size of image %s: %v", mainImagePath, err)
+	}
+	return generated
+}
+
+// imageURLs returns the URL of the main image, of the responsive variants and
+// of the copied original. A main image that is copied is the original.
+func imageURLs(outputs []imageOutput) generatedImage {
+	generated := generatedImage{URL: "/images/" + outputs[0].Name}
+	if outputs[0].Settings.Copy {
+		generated.OriginalURL = generated.URL
+	}
+	for _, output := range outputs[1:] {
+		if output.Settings.Copy {
+			generated.OriginalURL = "/images/" + output.Name
+			continue
+		}
+		if output.Settings.Square {
+			generated.ThumbnailURL = "/images/" + output.Name
+			continue
+		}
+		generated.Variants = append(generated.Variants, ImageVariant{
+			Width:   output.Settings.Width,
+			URL:     "/images/" + output.Name,
+			Density: output.Density,
+		})
+	}
+	slices.SortFunc(generated.Variants, func(a, b ImageVariant) int { return a.Width - b.Width })
+
+	// Density descriptors list the main image as 1x first, width
+	// descriptors list it with the variants by width.
+	var srcset []string
+	for _, variant := range generated.Variants {
+		if variant.Density > 0 {
+			if len(srcset) == 0 {
+				srcset = append(srcset, generated.URL+" 1x")
+			}
+			srcset = append(srcset, fmt.Sprintf("%s %gx", variant.URL, variant.Density))
+		} else {
+			srcset = append(srcset, fmt.Sprintf("%s %dw", variant.URL, variant.Width))
+		}
+	}
+	if len(srcset) > 0 && generated.Variants[0].Density == 0 {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", generated.URL, outputs[0].Settings.Width))
+	}
+	generated.Srcset = strings.Join(srcset, ", ")
+	return generated
+}
+
+// pruneImages removes the files in the images output directory that are not
+// produced by any post, along with their cache entries.
+func pruneImages(imagesOutputDir string, produced map[string]bool, cache *imageCache) error {
+	err := filepath.WalkDir(imagesOutputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(imagesOutputDir, path)
+		if err != nil {
+			return err
+		}
+		if produced[filepath.ToSlash(rel)] {
+			return nil
+		}
+		fmt.Printf("Removing orphaned image %s\n", path)
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	for name := range cache.Images {
+		if !produced[name] {
+			delete(cache.Images, name)
+		}
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the directories under root left empty, like album
+// directories whose images were all pruned, deepest first so that emptied
+// parents go too. root itself is kept.
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, dir := range slices.Backward(dirs) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		fmt.Printf("Removing empty directory %s\n", dir)
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyIfChanged copies the file at srcPath to dstPath, keeping its
+// modification time, unless dstPath has the same size and time already.
+func copyIfChanged(srcPath string, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(dstPath)
+	if err == nil && dstInfo.Size() == info.Size() && dstInfo.ModTime().Equal(info.ModTime()) {
+		return nil
+	}
+	err = copyImage(srcPath, dstPath, nil)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
+
+// withoutMissingImages returns a copy of posts where the main images missing
+// from imagesPath are emptied, so that they get the default image instead of
+// failing to build.
+func withoutMissingImages(posts []Post, imagesPath string) []Post {
+	cleared := slices.Clone(posts)
+	for i := range cleared {
+		post := &cleared[i]
+		if post.Image == "" || isRemoteImage(post.Image) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(imagesPath, imagePath(post.Image))); os.IsNotExist(err) {
+			fmt.Printf("Image %s of %q is missing, using the default image.\n", post.Image, post.Title)
+			post.Image = ""
+		}
+	}
+	return cleared
+}
+
+// setDefaultImage copies the default image to outputDir, as default-image
+// with its extension, and points the posts without an image at it.
+func setDefaultImage(posts []Post, defaultImage string, outputDir string) error {
+	name := "default-image" + filepath.Ext(defaultImage)
+	err := copyIfChanged(defaultImage, filepath.Join(outputDir, name))
+	if err != nil {
+		return err
+	}
+	width, height, _ := imageSize(filepath.Join(outputDir, name), nil)
+
+	for i := range posts {
+		post := &posts[i]
+		if post.Image == "" {
+			post.ImageURL = "/" + name
+			post.ImageWidth = width
+			post.ImageHeight = height
+			post.ImageEmbedURL = imageURL(post.ImageURL)
+		}
+	}
+	return nil
+}
+
+// syncImages mirrors the images generated into srcDir into dstDir. Files
+// differing in size or modification time are copied, keeping the time, and
+// files srcDir doesn't have are removed.
+func syncImages(srcDir string, dstDir string) error {
+	synced := make(map[string]bool)
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		synced[rel] = true
+		return copyIfChanged(path, filepath.Join(dstDir, rel))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = filepath.WalkDir(dstDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dstDir, path)
+		if err != nil {
+			return err
+		}
+		if synced[rel] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// imageSize returns the size of the image at path without decoding it fully.
+func imageSize(path string, limit fileLimiter) (int, int, error) {
+	defer limit.acquire()()
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// processImage decodes the source image once and resizes and encodes it into
+// every output under dir, copying it into the outputs that keep it as it is.
+// At most one file is open at a time, so workers can't deadlock waiting on
+// each other for the limiter. The time spent decoding, resizing and encoding
+// is added to the report.
+func processImage(srcPath string, dir string, outputs []imageOutput, limit fileLimiter, report *buildReport) error {
+	var img image.Image
+	for _, output := range outputs {
+		if output.Settings.Copy {
+			err := copyImage(srcPath, filepath.Join(dir, output.Name), limit)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if img == nil {
+			var err error
+			decodeStart := time.Now()
+			img, err = decodeImage(srcPath, limit)
+			report.addStage(stageImageDecode, decodeStart)
+			if err != nil {
+				return err
+			}
+		}
+		err := writeImage(img, filepath.Join(dir, output.Name), output.Settings, limit, report)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyImage copies the source image to dstPath byte for byte. The source is
+// read fully before the destination is opened, keeping a single file open.
+func copyImage(srcPath string, dstPath string, limit fileLimiter) error {
+	release := limit.acquire()
+	contents, err := os.ReadFile(srcPath)
+	release()
+	if err != nil {
+		return fmt.Errorf("error reading source image: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dstPath), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error creating image directory: %w", err)
+	}
+
+	defer limit.acquire()()
+	err = writeFileAtomic(dstPath, func(w io.Writer) error {
+		_, err := w.Write(contents)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error copying image: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file at path with write through a temporary
+// file next to it, renamed into place once complete. A build killed midway
+// never leaves a truncated file at path; at worst a temporary file remains,
+// which removeTempImages cleans up.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// removeTempImages removes the temporary files writeFileAtomic left in dir,
+// from a build that was killed while writing them.
+func removeTempImages(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), ".tmp") {
+			fmt.Printf("Removing unfinished image %s\n", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// decodeImage reads and decodes the image at path. GIFs decode to their
+// first frame.
+func decodeImage(path string, limit fileLimiter) (image.Image, error) {
+	if isGIF(path) {
+		return decodeGIF(path, limit)
+	}
+
+	defer limit.acquire()()
+
+	// Open the source image
+	srcImageFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening source image: %w", err)
+	}
+	defer srcImageFile.Close()
+
+	// Decode the image
+	img, _, err := image.Decode(srcImageFile)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	return img, nil
+}
+
+// decodeGIF decodes the first frame of the GIF at path. The frame is drawn
+// onto a canvas the size of the whole animation, as it can cover only part
+// of it; what it leaves uncovered stays transparent.
+func decodeGIF(path string, limit fileLimiter) (image.Image, error) {
+	release := limit.acquire()
+	contents, err := os.ReadFile(path)
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("error opening source image: %w", err)
+	}
+
+	config, err := gif.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	frame, err := gif.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return canvas, nil
+}
+
+// cropSquare returns the largest centered square of img.
+func cropSquare(img image.Image) image.Image {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	corner := bounds.Min.Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+	square := image.Rectangle{Min: corner, Max: corner.Add(image.Pt(side, side))}
+
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(square)
+	}
+	cropped := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(cropped, cropped.Bounds(), img, square.Min, draw.Src)
+	return cropped
+}
+
+// writeImage resizes img and encodes it to dstPath with the given settings,
+// adding the time spent on each to the report.
+func writeImage(img image.Image, dstPath string, settings imageSettings, limit fileLimiter, report *buildReport) error {
+	resizeStart := time.Now()
+	if settings.Square {
+		img = cropSquare(img)
+	}
+
+	// Resize the image to the configured width, keeping the aspect ratio
+	var resizedImg image.Image = resize.Resize(uint(settings.Width), 0, img, resizeFilters[settings.Filter])
+
+	// JPEG has no alpha channel, so transparent images are flattened onto
+	// the background color instead of turning black.
+	if settings.Format == "jpeg" && !isOpaque(resizedImg) {
+		background, _ := parseHexColor(settings.Background)
+		resizedImg = flatten(resizedImg, background)
+	}
+	report.addStage(stageImageResize, resizeStart)
+
+	err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error creating image directory: %w", err)
+	}
+
+	// Save the resized image
+	defer limit.acquire()()
+	encodeStart := time.Now()
+	defer report.addStage(stageImageEncode, encodeStart)
+	err = writeFileAtomic(dstPath, func(w io.Writer) error {
+		switch settings.Format {
+		case "png":
+			if settings.PNGColors > 0 {
+				resizedImg = quantize(resizedImg, settings.PNGColors)
+			}
+			encoder := png.Encoder{CompressionLevel: pngCompressionLevels[settings.PNGCompression]}
+			return encoder.Encode(w, resizedImg)
+		default:
+			return jpeg.Encode(w, resizedImg, &jpeg.Options{Quality: settings.Quality})
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error saving resized image: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestJPEG writes a width by height gradient to path as a JPEG,
+// creating its directory.
+func writeTestJPEG(t *testing.T, path string, width, height int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := jpeg.Encode(file, img, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestBuilder returns an image builder for posts, from the sources in
+// imagesPath into outputDir, with the cache of the previous call if any.
+func newTestBuilder(cfg Config, posts []Post, imagesPath, outputDir string) *imageBuilder {
+	return &imageBuilder{
+		cfg:        cfg,
+		imagesPath: imagesPath,
+		outputDir:  outputDir,
+		cache:      loadImageCache(filepath.Join(outputDir, ".image-cache.json")),
+		produced:   make(map[string]bool),
+		limit:      newFileLimiter(cfg.MaxOpenFiles),
+		report:     newBuildReport(),
+		names:      outputNames(posts, cfg),
+	}
+}
+
+func TestImageBuilderReencodesOnSettingsChange(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 64, 32)
+	posts := []Post{{Title: "A", Image: "a.jpg"}}
+
+	build := func(cfg Config) *buildReport {
+		t.Helper()
+		b := newTestBuilder(cfg, posts, imagesPath, outputDir)
+		b.build(newImageSource("a.jpg"))
+		if err := b.cache.save(); err != nil {
+			t.Fatal(err)
+		}
+		return b.report
+	}
+
+	cfg := defaultConfig()
+	cfg.ImageWidth = 32
+	steps := []struct {
+		name      string
+		quality   int
+		processed int
+		skipped   int
+	}{
+		{"first build", 75, 1, 0},
+		{"unchanged", 75, 0, 1},
+		{"quality raised", 90, 1, 0},
+		{"unchanged again", 90, 0, 1},
+	}
+	for _, step := range steps {
+		cfg.ImageQuality = step.quality
+		report := build(cfg)
+		if report.ImagesProcessed != step.processed || report.ImagesSkipped != step.skipped {
+			t.Errorf("%s: processed %d and skipped %d, want %d and %d",
+				step.name, report.ImagesProcessed, report.ImagesSkipped, step.processed, step.skipped)
+		}
+	}
+}
+
+func TestImageCacheUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jpg")
+	if err := os.WriteFile(path, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry := imageCacheEntry{Hash: "abc", imageSettings: imageSettings{Width: 32, Format: "jpeg", Quality: 75}}
+	cache := loadImageCache(filepath.Join(dir, "cache.json"))
+	cache.Images["a.jpg"] = entry
+
+	higherQuality := entry
+	higherQuality.Quality = 90
+	otherSource := entry
+	otherSource.Hash = "def"
+
+	tests := []struct {
+		name  string
+		path  string
+		entry imageCacheEntry
+		want  bool
+	}{
+		{"same source and settings", path, entry, true},
+		{"other quality", path, higherQuality, false},
+		{"other source", path, otherSource, false},
+		{"missing output", filepath.Join(dir, "missing.jpg"), entry, false},
+	}
+	for _, test := range tests {
+		if got := cache.upToDate("a.jpg", test.path, test.entry); got != test.want {
+			t.Errorf("%s: upToDate = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// srcsetFiles returns the files the URLs of srcset point to in outputDir.
+func srcsetFiles(outputDir string, srcset string) []string {
+	var files []string
+	for _, candidate := range strings.Split(srcset, ", ") {
+		url, _, _ := strings.Cut(candidate, " ")
+		files = append(files, filepath.Join(outputDir, filepath.FromSlash(url)))
+	}
+	return files
+}
+
+func TestResponsiveLayouts(t *testing.T) {
+	tests := []struct {
+		layout  string
+		variant string
+	}{
+		{"flat", "a-16.jpg"},
+		{"dirs", "16/a.jpg"},
+	}
+	for _, test := range tests {
+		t.Run(test.layout, func(t *testing.T) {
+			dir := t.TempDir()
+			imagesPath := filepath.Join(dir, "source")
+			outputDir := filepath.Join(dir, "docs")
+			writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 64, 32)
+			cfg := defaultConfig()
+			cfg.ImageWidth = 32
+			cfg.ResponsiveWidths = []int{16}
+			cfg.ImageLayout = test.layout
+
+			posts := []Post{{Title: "A", Image: "a.jpg"}}
+			buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, newBuildReport())
+			srcset := posts[0].ImageSrcset
+			if want := "/images/" + test.variant + " 16w, /images/a.jpg 32w"; srcset != want {
+				t.Fatalf("srcset = %q, want %q", srcset, want)
+			}
+			for _, file := range srcsetFiles(outputDir, srcset) {
+				if _, err := os.Stat(file); err != nil {
+					t.Errorf("srcset references a missing file: %v", err)
+				}
+			}
+
+			// Switching layouts prunes the variants of the other one.
+			other := "dirs"
+			if test.layout == "dirs" {
+				other = "flat"
+			}
+			cfg.ImageLayout = other
+			posts = []Post{{Title: "A", Image: "a.jpg"}}
+			buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, newBuildReport())
+			if _, err := os.Stat(filepath.Join(outputDir, "images", test.variant)); !os.IsNotExist(err) {
+				t.Errorf("variant %s of the %s layout was not pruned", test.variant, test.layout)
+			}
+			for _, file := range srcsetFiles(outputDir, posts[0].ImageSrcset) {
+				if _, err := os.Stat(file); err != nil {
+					t.Errorf("srcset references a missing file: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileLimiterCapsOpenFiles(t *testing.T) {
+	limit := newFileLimiter(2)
+	var mu sync.Mutex
+	open, most := 0, 0
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := limit.acquire()
+			mu.Lock()
+			open++
+			most = max(most, open)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			open--
+			mu.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("%d files were open at once, want at most 2", most)
+	}
+}
+
+func TestBuildImagesWithOneOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	var posts []Post
+	for i := range 12 {
+		name := fmt.Sprintf("%d.jpg", i)
+		writeTestJPEG(t, filepath.Join(imagesPath, name), 32, 16)
+		posts = append(posts, Post{Title: name, Image: name})
+	}
+	cfg := defaultConfig()
+	cfg.ImageWidth = 16
+	cfg.ResponsiveWidths = []int{8}
+	cfg.ImageWorkers = 8
+	cfg.MaxOpenFiles = 1
+
+	report := newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesProcessed != len(posts) || report.ImagesFailed != 0 {
+		t.Errorf("processed %d images and %d failed, want %d and none: %v",
+			report.ImagesProcessed, report.ImagesFailed, len(posts), report.Errors)
+	}
+}
+
+func TestTransparentImageFlattenedOntoBackground(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	tests := []struct {
+		background string
+		want       color.RGBA
+	}{
+		{"#ffffff", color.RGBA{255, 255, 255, 255}},
+		{"#ff0000", color.RGBA{255, 0, 0, 255}},
+		{"#00f", color.RGBA{0, 0, 255, 255}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "a.jpg")
+		settings := imageSettings{Width: 8, Format: "jpeg", Quality: 100, Filter: "lanczos3", Background: test.background}
+		if err := writeImage(transparent, path, settings, nil, newBuildReport()); err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeImage(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, g, b, _ := img.At(4, 4).RGBA()
+		got := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+		if !closeColors(got, test.want) {
+			t.Errorf("background %s: pixel is %v, want %v", test.background, got, test.want)
+		}
+	}
+}
+
+// closeColors reports whether a and b are the same color give or take the
+// JPEG encoding.
+func closeColors(a, b color.RGBA) bool {
+	diff := func(x, y uint8) int { return max(int(x), int(y)) - min(int(x), int(y)) }
+	return diff(a.R, b.R) <= 8 && diff(a.G, b.G) <= 8 && diff(a.B, b.B) <= 8
+}
+
+func TestCopyModeCopiesBytes(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 32, 16)
+	// Copies are not decoded, so any bytes do.
+	if err := os.WriteFile(filepath.Join(imagesPath, "b.webp"), []byte("not decodable"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.ProcessImages = "copy"
+	posts := []Post{{Title: "A", Image: "a.jpg"}, {Title: "B", Image: "b.webp"}}
+
+	report := newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesFailed != 0 {
+		t.Fatalf("images failed: %v", report.Errors)
+	}
+	for _, post := range posts {
+		source, err := os.ReadFile(filepath.Join(imagesPath, post.Image))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(post.ImageURL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(source, copied) {
+			t.Errorf("%s differs from its source", post.ImageURL)
+		}
+	}
+}
+
+func TestImageSourceOverrides(t *testing.T) {
+	tests := []struct {
+		ref     string
+		path    string
+		width   int
+		quality int
+		name    string
+	}{
+		{"pano.jpg", "pano.jpg", 0, 0, "pano.jpg"},
+		{"pano.jpg?w=24", "pano.jpg", 24, 0, "pano-w24.jpg"},
+		{"pano.jpg?w=24&q=90", "pano.jpg", 24, 90, "pano-w24-q90.jpg"},
+		{"pano.jpg?q=90&w=24", "pano.jpg", 24, 90, "pano-w24-q90.jpg"},
+		{"pano.jpg?w=-1&q=101&x=1", "pano.jpg", 0, 0, "pano.jpg"},
+	}
+	for _, test := range tests {
+		src := newImageSource(test.ref)
+		if src.Path != test.path || src.Width != test.width || src.Quality != test.quality {
+			t.Errorf("%s: source is %+v, want %s with width %d and quality %d",
+				test.ref, src, test.path, test.width, test.quality)
+		}
+		if name := src.name(); name != test.name {
+			t.Errorf("%s: name = %q, want %q", test.ref, name, test.name)
+		}
+	}
+}
+
+func TestWidthOverrideResizes(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	writeTestJPEG(t, filepath.Join(imagesPath, "pano.jpg"), 64, 32)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 16
+	posts := []Post{{Title: "Wide", Image: "pano.jpg?w=48"}, {Title: "Narrow", Image: "pano.jpg"}}
+
+	report := newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesFailed != 0 {
+		t.Fatalf("images failed: %v", report.Errors)
+	}
+	tests := []struct {
+		post  Post
+		url   string
+		width int
+	}{
+		{posts[0], "/images/pano-w48.jpg", 48},
+		{posts[1], "/images/pano.jpg", 16},
+	}
+	for _, test := range tests {
+		if test.post.ImageURL != test.url || test.post.ImageWidth != test.width {
+			t.Errorf("%s: image is %s at width %d, want %s at width %d",
+				test.post.Title, test.post.ImageURL, test.post.ImageWidth, test.url, test.width)
+		}
+		width, _, err := imageSize(filepath.Join(outputDir, filepath.FromSlash(test.url)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != test.width {
+			t.Errorf("%s is %d pixels wide, want %d", test.url, width, test.width)
+		}
+	}
+}
+
+func TestSameNameInOtherDirectories(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	writeTestJPEG(t, filepath.Join(imagesPath, "album/a.jpg"), 64, 32)
+	writeTestJPEG(t, filepath.Join(imagesPath, "other/a.jpg"), 32, 32)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 32
+	cfg.ResponsiveWidths = nil
+	cfg.ImageWorkers = 2
+	posts := []Post{{Title: "Album", Image: "album/a.jpg"}, {Title: "Other", Image: "other/a.jpg"}}
+
+	report := newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesFailed != 0 {
+		t.Fatalf("images failed: %v", report.Errors)
+	}
+	tests := []struct {
+		post   Post
+		url    string
+		height int
+	}{
+		{posts[0], "/images/a.jpg", 16},
+		{posts[1], "/images/a-2.jpg", 32},
+	}
+	for _, test := range tests {
+		if test.post.ImageURL != test.url {
+			t.Errorf("%s: image is %s, want %s", test.post.Title, test.post.ImageURL, test.url)
+		}
+		_, height, err := imageSize(filepath.Join(outputDir, filepath.FromSlash(test.url)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != test.height {
+			t.Errorf("%s is %d pixels high, want %d", test.url, height, test.height)
+		}
+	}
+}
+
+func TestPostQualityOverridesGlobalQuality(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 64, 32)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 64
+	cfg.ImageQuality = 95
+
+	// size builds the post into an output directory of its own and returns
+	// the size of its image.
+	size := func(name string, post Post) int64 {
+		t.Helper()
+		outputDir := filepath.Join(dir, name)
+		posts := []Post{post}
+		report := newBuildReport()
+		buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+		if report.ImagesFailed != 0 {
+			t.Fatalf("%s: images failed: %v", name, report.Errors)
+		}
+		info, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(posts[0].ImageURL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	global := size("global", Post{Title: "A", Image: "a.jpg"})
+	low := size("low", Post{Title: "A", Image: "a.jpg", Quality: 20})
+	same := size("same", Post{Title: "A", Image: "a.jpg", Quality: 95})
+	if low >= global {
+		t.Errorf("image at post quality 20 is %d bytes, want less than the %d bytes at the global 95", low, global)
+	}
+	if same != global {
+		t.Errorf("image at post quality 95 is %d bytes, want the %d bytes at the global 95", same, global)
+	}
+}
+
+func TestInlinedFilesNeeded(t *testing.T) {
+	cfg := defaultConfig()
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{`{{range .Posts}}<img src="{{.ImageEmbedURL}}">{{end}}`, false},
+		{`{{range .Posts}}<a href="/posts/">Goes to .URL</a>{{end}}`, false},
+		{`{{range $post := .Posts}}<a href="{{$post.ImageURL}}">{{end}}`, true},
+		{`{{range .Posts}}{{range .Images}}{{.URL}}{{end}}{{end}}`, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "index.html")
+		if err := os.WriteFile(path, []byte(test.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := inlinedFilesNeeded(cfg, path); got != test.want {
+			t.Errorf("%s: inlined files needed = %v, want %v", test.source, got, test.want)
+		}
+	}
+
+	cfg.API = true
+	if !inlinedFilesNeeded(cfg) {
+		t.Errorf("inlined files not needed by the JSON API")
+	}
+}
+
+func TestAnimatedGIFFirstFrame(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	palette := color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	animation := &gif.GIF{}
+	for i := range palette {
+		frame := image.NewPaletted(image.Rect(0, 0, 32, 16), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i)
+		}
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, animation); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(imagesPath, "anim.gif"), encoded.String())
+	cfg := defaultConfig()
+	cfg.ImageWidth = 16
+	cfg.KeepOriginalGIF = true
+	posts := []Post{{Title: "Anim", Image: "anim.gif"}}
+
+	report := newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesFailed != 0 {
+		t.Fatalf("images failed: %v", report.Errors)
+	}
+	if posts[0].ImageURL != "/images/anim.jpg" {
+		t.Fatalf("image URL = %q, want /images/anim.jpg", posts[0].ImageURL)
+	}
+	img, err := decodeImage(filepath.Join(outputDir, "images", "anim.jpg"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width := img.Bounds().Dx(); width != 16 {
+		t.Errorf("still is %d pixels wide, want 16", width)
+	}
+	r, g, b, _ := img.At(8, 4).RGBA()
+	if got := (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}); !closeColors(got, palette[0].(color.RGBA)) {
+		t.Errorf("still is %v, want the red of the first frame", got)
+	}
+	if original := readTestFile(t, filepath.Join(outputDir, "images", "anim.gif")); original != encoded.String() {
+		t.Errorf("the original GIF was not copied as is")
+	}
+}
+
+func TestPNGCompressionShrinksOutput(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestJPEG(t, source, 64, 64)
+	img, err := decodeImage(source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := func(compression string, colors int) int64 {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "a.png")
+		settings := imageSettings{Width: 64, Format: "png", Filter: "lanczos3", PNGCompression: compression, PNGColors: colors}
+		if err := writeImage(img, path, settings, nil, newBuildReport()); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	none, best := size("none", 0), size("best", 0)
+	if best >= none {
+		t.Errorf("best compression wrote %d bytes, no compression %d", best, none)
+	}
+	if quantized := size("best", 16); quantized >= best {
+		t.Errorf("16 colors wrote %d bytes, every color %d", quantized, best)
+	}
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "images")
+	for _, dir := range []string{"travel/2024/empty", "travel/empty", "kept"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(root, "kept/a.jpg"), "jpeg")
+
+	if err := removeEmptyDirs(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "travel")); !os.IsNotExist(err) {
+		t.Errorf("album dir left empty by its subdirs was kept")
+	}
+	if _, err := os.Stat(filepath.Join(root, "kept/a.jpg")); err != nil {
+		t.Errorf("dir with an image was removed: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeEmptyDirs(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("empty root was removed: %v", err)
+	}
+	if err := removeEmptyDirs(filepath.Join(root, "missing")); err != nil {
+		t.Errorf("missing root: %v", err)
+	}
+}
+
+func TestInterruptedBuildLeavesNoCorruptImage(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	imagesOutputDir := filepath.Join(outputDir, "images")
+	writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 64, 32)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 32
+	posts := []Post{{Title: "A", Image: "a.jpg"}}
+
+	// A build killed while encoding leaves a partial temporary file, and
+	// possibly a truncated image from a build before writes were atomic,
+	// but never saves the cache.
+	var encoded bytes.Buffer
+	img, err := decodeImage(filepath.Join(imagesPath, "a.jpg"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	truncated := encoded.String()[:encoded.Len()/2]
+	writeTestFile(t, filepath.Join(imagesOutputDir, ".a.jpg.tmp"), truncated)
+	writeTestFile(t, filepath.Join(imagesOutputDir, "a.jpg"), truncated)
+
+	report := newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesProcessed != 1 {
+		t.Errorf("processed %d images, want the truncated one encoded again", report.ImagesProcessed)
+	}
+	if _, err := os.Stat(filepath.Join(imagesOutputDir, ".a.jpg.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file was kept")
+	}
+	if img, err := decodeImage(filepath.Join(imagesOutputDir, "a.jpg"), nil); err != nil {
+		t.Errorf("output is corrupt: %v", err)
+	} else if width := img.Bounds().Dx(); width != 32 {
+		t.Errorf("output is %d pixels wide, want 32", width)
+	}
+
+	// Killed again while encoding a changed source, the complete image of
+	// the previous build stays in place and is encoded again next time.
+	writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 96, 32)
+	writeTestFile(t, filepath.Join(imagesOutputDir, ".a.jpg.tmp"), truncated)
+	posts = []Post{{Title: "A", Image: "a.jpg"}}
+	report = newBuildReport()
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, report)
+	if report.ImagesProcessed != 1 {
+		t.Errorf("processed %d images, want the changed one encoded again", report.ImagesProcessed)
+	}
+	if img, err := decodeImage(filepath.Join(imagesOutputDir, "a.jpg"), nil); err != nil {
+		t.Errorf("output is corrupt: %v", err)
+	} else if width := img.Bounds().Dx(); width != 32 {
+		t.Errorf("output is %d pixels wide, want 32", width)
+	}
+	if posts[0].ImageHeight != 11 {
+		t.Errorf("image height is %d, want 11 from the changed source", posts[0].ImageHeight)
+	}
+}
+
+func TestWriteFileAtomicKeepsTargetOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestFile(t, path, "complete")
+
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		fmt.Fprint(w, "part")
+		return errors.New("killed")
+	})
+	if err == nil {
+		t.Fatal("writeFileAtomic returned no error")
+	}
+	if got := readTestFile(t, path); got != "complete" {
+		t.Errorf("target holds %q after a failed write, want it unchanged", got)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), ".a.jpg.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file was kept")
+	}
+}
+
+func TestVerifyImagesCatchesCorruptOutputs(t *testing.T) {
+	dir := t.TempDir()
+	imagesPath := filepath.Join(dir, "source")
+	outputDir := filepath.Join(dir, "docs")
+	writeTestJPEG(t, filepath.Join(imagesPath, "a.jpg"), 64, 32)
+	writeTestJPEG(t, filepath.Join(imagesPath, "b.jpg"), 64, 32)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 32
+	cfg.ResponsiveWidths = []int{16}
+	posts := []Post{{Title: "A", Image: "a.jpg"}, {Title: "B", Image: "b.jpg"}}
+	buildImages(posts, cfg, imagesPath, outputDir, nil, nil, true, newBuildReport())
+
+	report := newBuildReport()
+	if err := verifyImages(posts, cfg, outputDir, nil, report); err != nil {
+		t.Fatalf("valid images failed verification: %v", err)
+	}
+
+	// One variant is cut short and one image has the wrong size.
+	truncated := filepath.Join(outputDir, "images", "a-16.jpg")
+	contents := readTestFile(t, truncated)
+	writeTestFile(t, truncated, contents[:len(contents)/2])
+	resized := filepath.Join(outputDir, "images", "b.jpg")
+	writeTestJPEG(t, resized, 24, 12)
+
+	err := verifyImages(posts, cfg, outputDir, nil, report)
+	if err == nil {
+		t.Fatal("corrupt images passed verification")
+	}
+	for _, path := range []string{truncated, resized} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("error doesn't name %s: %v", path, err)
+		}
+	}
+	if report.ImagesFailed != 2 {
+		t.Errorf("report has %d failed images, want 2", report.ImagesFailed)
+	}
+}
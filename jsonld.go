@@ -0,0 +1,77 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+// imageObject is a schema.org ImageObject.
+type imageObject struct {
+	Type       string `json:"@type"`
+	ContentURL string `json:"contentUrl"`
+	Name       string `json:"name,omitempty"`
+	Caption    string `json:"caption,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+}
+
+// imageGallery is a schema.org ImageGallery.
+type imageGallery struct {
+	Context string        `json:"@context"`
+	Type    string        `json:"@type"`
+	URL     string        `json:"url"`
+	Image   []imageObject `json:"image"`
+}
+
+// imageGalleryJSONLD returns a JSON-LD script block describing every post
+// image as an ImageGallery. It returns an empty block when baseURL is unset,
+// as JSON-LD needs absolute URLs.
+func imageGalleryJSONLD(posts []Post, baseURL string) (template.HTML, error) {
+	if baseURL == "" {
+		return "", nil
+	}
+
+	gallery := imageGallery{
+		Context: "https://schema.org",
+		Type:    "ImageGallery",
+		URL:     absoluteURL(baseURL, "/"),
+		Image:   make([]imageObject, 0, len(posts)),
+	}
+	for _, post := range posts {
+		if post.ImageURL != "" {
+			gallery.Image = append(gallery.Image, imageObject{
+				Type:       "ImageObject",
+				ContentURL: absoluteURL(baseURL, post.ImageURL),
+				Name:       post.Title,
+				Caption:    post.Caption,
+				Width:      post.ImageWidth,
+				Height:     post.ImageHeight,
+			})
+		}
+		for _, image := range post.Images {
+			caption := image.Caption
+			if caption == "" {
+				caption = post.Caption
+			}
+			gallery.Image = append(gallery.Image, imageObject{
+				Type:       "ImageObject",
+				ContentURL: absoluteURL(baseURL, image.URL),
+				Name:       post.Title,
+				Caption:    caption,
+				Width:      image.Width,
+				Height:     image.Height,
+			})
+		}
+	}
+
+	return jsonLDScript(gallery)
+}
+
+// absoluteURL joins the site base URL and a root relative path. URLs that
+// are absolute already, like remote images, are returned as they are.
+func absoluteURL(baseURL string, path string) string {
+	if isRemoteImage(path) {
+		return path
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// listedPost is a post as printed by the list command.
+type listedPost struct {
+	Title  string   `json:"title"`
+	Image  string   `json:"image"`
+	Date   string   `json:"date,omitempty"`
+	Status string   `json:"status"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// runList prints the posts of index.json with their status, without
+// writing anything.
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	drafts := flags.Bool("drafts", false, "only list drafts")
+	tag := flags.String("tag", "", "only list posts with the tag")
+	asJSON := flags.Bool("json", false, "print the posts as JSON")
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	postsData, _, err := readPosts(cfg, "source/index.json")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	listed := make([]listedPost, 0, len(postsData.Posts))
+	for _, post := range postsData.Posts {
+		if *drafts && !post.Draft {
+			continue
+		}
+		if *tag != "" && !slices.ContainsFunc(post.Tags, func(t string) bool { return slugify(t) == slugify(*tag) }) {
+			continue
+		}
+		listed = append(listed, listedPost{
+			Title:  post.Title,
+			Image:  post.Image,
+			Date:   post.Date,
+			Status: post.status(now, cfg.location()),
+			Tags:   post.Tags,
+		})
+	}
+
+	if *asJSON {
+		output, err := json.MarshalIndent(listed, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TITLE\tIMAGE\tDATE\tSTATUS\tTAGS")
+	for _, post := range listed {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", post.Title, post.Image, post.Date, post.Status, strings.Join(post.Tags, ", "))
+	}
+	return w.Flush()
+}
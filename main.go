@@ -2,35 +2,184 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"slices"
-
-	"image"
-	"image/jpeg"
-
-	"github.com/nfnt/resize"
+	"strings"
+	"time"
 )
 
 func main() {
-	build()
-	serve()
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "":
+		err = runBuildAndServe(args)
+	case "build":
+		err = runBuild(args)
+	case "serve":
+		err = runServe(args)
+	case "list":
+		err = runList(args)
+	case "check":
+		err = runCheck(args)
+	case "meta":
+		err = runMeta(args)
+	case "dev":
+		err = runDev(args)
+	case "purge":
+		err = runPurge(args)
+	case "optimize":
+		err = runOptimize(args)
+	case "config":
+		err = runConfig(args)
+	case "import-wxr":
+		err = runImportWXR(args)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func serve() {
-	fs := http.FileServer(http.Dir("docs"))
+// addBuildFlags registers the flags shared by the commands that build.
+func addBuildFlags(flags *flag.FlagSet, opts *buildOptions) {
+	flags.BoolVar(&opts.ShowAdditions, "show-additions", false, "print the posts that would be added to index.json and exit")
+	flags.StringVar(&opts.Since, "since", "", "only process images changed since a time, duration or git ref")
+	flags.BoolVar(&opts.HTMLOnly, "html-only", false, "only render pages, leaving images and index.json untouched")
+	flags.BoolVar(&opts.KeepEmptyDirs, "no-prune-empty-dirs", false, "keep image directories left empty after removing orphaned images")
+	flags.BoolVar(&opts.WarnA11y, "warn-a11y", false, "warn about images without alt text")
+	flags.BoolVar(&opts.StrictA11y, "strict-a11y", false, "fail the build on images without alt text")
+	flags.BoolVar(&opts.FailOnWarnings, "fail-on-warnings", false, "fail the build when there were warnings, after finishing it")
+	flags.BoolVar(&opts.VerifyImages, "verify-images", false, "decode the generated images and fail the build on unreadable ones")
+}
+
+// runBuildAndServe builds the site and serves it, the default command. A
+// failed build is reported and whatever was generated is served anyway.
+func runBuildAndServe(args []string) error {
+	var opts buildOptions
+	flags := flag.NewFlagSet("bricksling", flag.ExitOnError)
+	addBuildFlags(flags, &opts)
+	watchFlag := flags.Bool("watch", false, "rebuild when sources change while serving")
+	watchScope := flags.String("watch-scope", "", "what to watch: all, template, data or images (default from config)")
+	templateOnly := flags.Bool("watch-template-only", false, "watch only the templates, same as --watch --watch-scope template")
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	if *templateOnly {
+		*watchFlag = true
+		*watchScope = "template"
+	}
+	if *watchScope == "" {
+		*watchScope = cfg.WatchScope
+	}
+	if !validWatchScope(*watchScope) {
+		return fmt.Errorf("unknown watch scope %q", *watchScope)
+	}
+
+	_, err = build(cfg, opts)
+	if err != nil {
+		fmt.Printf("Build failed: %v\n", err)
+	}
+	if opts.ShowAdditions {
+		return err
+	}
+	if *watchFlag {
+		go watch(cfg, opts, *watchScope)
+	}
+	return serve(cfg)
+}
+
+// runServe serves the generated site without building it.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	return serve(cfg)
+}
+
+// runBuild builds the site once, failing when the build does. With
+// --archive the site is packed into an archive once built.
+func runBuild(args []string) error {
+	var opts buildOptions
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	addBuildFlags(flags, &opts)
+	summaryJSON := flags.Bool("summary-json", false, "print a JSON summary of the build on stdout, logging to stderr")
+	archive := flags.String("archive", "", "pack the built site into a .tar.gz, .tgz, .tar or .zip archive")
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	if *archive != "" {
+		if _, err := archiveFormat(*archive); err != nil {
+			return err
+		}
+	}
+
+	buildAndArchive := func() (*buildReport, error) {
+		report, err := build(cfg, opts)
+		if err == nil && *archive != "" && !opts.ShowAdditions {
+			err = writeArchive(*archive, cfg.outputProfiles()[0].OutputDir)
+		}
+		return report, err
+	}
+
+	if !*summaryJSON {
+		_, err = buildAndArchive()
+		return err
+	}
+
+	// Keep stdout for the summary alone by sending the build logs to stderr.
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	report, err := buildAndArchive()
+	os.Stdout = stdout
+
+	if writeErr := report.write(os.Stdout); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// serve serves the generated site over plain HTTP on :8080, or over HTTPS
+// with Let's Encrypt certificates when autocert domains are configured.
+func serve(cfg Config) error {
+	outputDir := cfg.outputProfiles()[0].OutputDir
+	if len(cfg.Autocert.Domains) > 0 {
+		return serveAutocert(cfg.Autocert, publicFileServer(outputDir))
+	}
+
+	fs := http.FileServer(http.Dir(outputDir))
 	http.Handle("/", http.StripPrefix("/", fs))
 
 	log.Println("Server starting at :8080")
 	err := http.ListenAndServe(":8080", nil)
 	if err != nil {
-		log.Fatal("Server failed to start:", err)
+		return fmt.Errorf("server failed to start: %w", err)
 	}
+	return nil
 }
 
 // Post represents the structure of each post in the JSON data.
@@ -38,157 +187,515 @@ type Post struct {
 	Title   string `json:"title"`
 	Caption string `json:"caption"`
 	Image   string `json:"image"`
+	// ShortCaption is the caption as text cut to captionLength, set during
+	// the build.
+	ShortCaption string `json:"-"`
+	// CaptionHTML is the caption as HTML, sanitized with captionPolicy, set
+	// during the build. Caption itself is always escaped.
+	CaptionHTML template.HTML `json:"-"`
+	// Alt is the alt text of the image. It defaults to the caption.
+	Alt  string   `json:"alt,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	// Date is when the post was published, in RFC 3339 or as 2006-01-02.
+	// Posts dated in the future are scheduled and left out until then.
+	Date string `json:"date,omitempty"`
+	// PublishedAt is the date in the configured timezone and FormattedDate
+	// the date formatted with dateFormat, set during the build for posts
+	// with a valid date.
+	PublishedAt   time.Time `json:"-"`
+	FormattedDate string    `json:"-"`
+	// Draft posts are left out of the build.
+	Draft bool `json:"draft,omitempty"`
+	// Visibility is public, the default, unlisted for posts only on their
+	// own page, left out of the index, tag pages, feeds and sitemap, or
+	// private for posts left out of the build like drafts.
+	Visibility string `json:"visibility,omitempty"`
+	// Params are free form values for templates, like {{.Params.camera}}.
+	Params Params `json:"params,omitempty"`
+	// Quality is the JPEG quality of the images of the post, from 1 to 100,
+	// for those without a quality override of their own. Zero keeps
+	// imageQuality.
+	Quality int `json:"quality,omitempty"`
+	// Pin pins the post to the top of the index and tag pages, the highest
+	// pin first. Zero leaves the post in place.
+	Pin int `json:"pin,omitempty"`
+	// Thumbnail asks for a square thumbnail of the image, or with false
+	// for none, whether the templates use thumbnails or not.
+	Thumbnail *bool `json:"thumbnail,omitempty"`
+
+	// URL is the URL of the page of the post, set during the build when
+	// there is a post template.
+	URL string `json:"-"`
+	// Index is the position of the post on the page being rendered, from
+	// zero, and AboveFold whether it is among the first aboveFold posts.
+	Index     int  `json:"-"`
+	AboveFold bool `json:"-"`
+	// ModTime is when the image or the data of the post last changed,
+	// whichever is later, set during the build.
+	ModTime time.Time `json:"-"`
+	// Images are the gallery images of the post, next to the main image.
+	Images []PostImage `json:"images,omitempty"`
+
+	// ImageURL is the URL of the generated image, and ImageWidth and
+	// ImageHeight its size in pixels, set during the build.
+	ImageURL    string `json:"-"`
+	ImageWidth  int    `json:"-"`
+	ImageHeight int    `json:"-"`
+	// ImageVariants are the responsive variants of the image, smallest
+	// first, and ImageSrcset a srcset attribute value listing them along
+	// with the main image.
+	ImageVariants []ImageVariant `json:"-"`
+	ImageSrcset   string         `json:"-"`
+	// ImageSizes is the sizes attribute going with ImageSrcset on the page
+	// being rendered.
+	ImageSizes string `json:"-"`
+	// ImageOriginalURL is the URL of the source image copied as it is, for
+	// example an animated GIF kept next to its static thumbnail.
+	ImageOriginalURL string `json:"-"`
+	// ThumbnailURL is the URL of the square thumbnail of the image, when
+	// one is generated.
+	ThumbnailURL string `json:"-"`
+	// ImageEmbedURL is the URL to embed the image with in pages: a data URI
+	// for images under inlineBelowBytes, ImageURL otherwise.
+	ImageEmbedURL template.URL `json:"-"`
 }
 
 // PostsData represents the structure of the JSON data.
 type PostsData struct {
 	Posts []Post `json:"posts"`
+
+	// fields are the top level keys of the JSON data in their original
+	// order with the values of the ones other than posts, so that rewriting
+	// index.json keeps settings stored next to the posts.
+	fields []jsonField
+}
+
+// buildOptions are the per run options of a build, set from the command line.
+type buildOptions struct {
+	// ShowAdditions prints the posts that would be added to index.json and
+	// the resulting diff without writing anything.
+	ShowAdditions bool
+	// Since limits image processing to posts changed since a time or git
+	// ref. Pages are still generated for every post.
+	Since string
+	// HTMLOnly only renders pages from the already generated images, without
+	// processing images or adding new ones to index.json.
+	HTMLOnly bool
+	// KeepEmptyDirs keeps the image directories left empty by pruning.
+	KeepEmptyDirs bool
+	// WarnA11y prints the posts with images missing alt text, and StrictA11y
+	// fails the build on them.
+	WarnA11y   bool
+	StrictA11y bool
+	// FailOnWarnings fails a build that had warnings, once it finished.
+	FailOnWarnings bool
+	// VerifyImages decodes every generated image after processing and fails
+	// the build on the ones that are unreadable or have the wrong size.
+	VerifyImages bool
 }
 
-func build() {
+// build builds the site and returns a report of what it did.
+func build(cfg Config, opts buildOptions) (*buildReport, error) {
+	start := time.Now()
+	report := newBuildReport()
+	err := buildSite(cfg, opts, report)
+	if warnings := report.warningCount(); warnings > 0 && !opts.ShowAdditions {
+		fmt.Printf("Build finished with %d warnings.\n", warnings)
+		if err == nil && opts.FailOnWarnings {
+			err = fmt.Errorf("build had %d warnings", warnings)
+		}
+	}
+	report.finish(start, cfg.outputProfiles()[0].OutputDir, err)
+	if stages := report.stageSummary(); stages != "" && !opts.ShowAdditions {
+		fmt.Printf("Build took %dms: %s.\n", report.DurationMs, stages)
+	}
+	return report, err
+}
+
+func buildSite(cfg Config, opts buildOptions, report *buildReport) error {
 	// Define paths
 	indexJSONPath := "source/index.json"
+	dataJSONPath := "source/data.json"
 	imagesPath := "source/images"
 	templatePath := "template/index.html"
-	outputHTMLPath := "docs/index.html"
-	imagesOutputDir := "docs/images"
+	tagTemplatePath := "template/tag.html"
+	postTemplatePath := "template/post.html"
+	profiles := cfg.outputProfiles()
+	outputDir := profiles[0].OutputDir
 
 	// Read and parse the JSON data
-	var postsData PostsData
-	jsonFile, err := os.Open(indexJSONPath)
+	loadStart := time.Now()
+	postsData, byteValue, err := readPosts(cfg, indexJSONPath)
+	report.addStage(stageLoad, loadStart)
 	if err != nil {
-		fmt.Printf("Error opening JSON file: %v\n", err)
-		return
+		return err
 	}
-	defer jsonFile.Close()
 
-	byteValue, err := io.ReadAll(jsonFile)
+	fmt.Printf("JSON data: %+v\n", postsData)
+	if len(postsData.Posts) == 0 {
+		fmt.Printf("No posts in %s, building an empty site.\n", indexJSONPath)
+	}
 
+	loadStart = time.Now()
+	siteData, err := loadSiteData(dataJSONPath)
+	report.addStage(stageLoad, loadStart)
 	if err != nil {
-		fmt.Printf("Error reading JSON file: %v\n", err)
-		return
+		return fmt.Errorf("error reading site data: %w", err)
 	}
 
-	err = json.Unmarshal(byteValue, &postsData)
-
+	// Find unused images
+	unusedImages, err := findUnusedImages(postsData, imagesPath, cfg.IgnoreImages)
 	if err != nil {
-		fmt.Printf("Error parsing JSON data: %v\n", err)
-		return
+		return fmt.Errorf("error finding unused images: %w", err)
 	}
 
-	fmt.Printf("JSON data: %+v\n", postsData)
-
-	// Parse the template
-	tmpl, err := template.ParseFiles(templatePath)
-	if err != nil {
-		fmt.Printf("Error parsing template: %v\n", err)
-		return
+	if opts.ShowAdditions && cfg.SQLite.Path != "" {
+		showSQLiteAdditions(cfg.SQLite, unusedImages)
+		return nil
+	}
+	if opts.ShowAdditions {
+		err = showAdditions(indexJSONPath, byteValue, postsData, unusedImages)
+		if err != nil {
+			return fmt.Errorf("error showing additions: %w", err)
+		}
+		return nil
 	}
 
-	// Create the output HTML file
-	outputFile, err := os.Create(outputHTMLPath)
+	// Parse the templates
+	parseStart := time.Now()
+	tmpl, err := loadTemplate(cfg.TemplateEngine, templatePath)
 	if err != nil {
-		fmt.Printf("Error creating output HTML file: %v\n", err)
-		return
+		return fmt.Errorf("error parsing template: %w", err)
 	}
-	defer outputFile.Close()
-
-	// Create the images output directory if it doesn't exist
-	if _, err := os.Stat(imagesOutputDir); os.IsNotExist(err) {
-		os.MkdirAll(imagesOutputDir, os.ModePerm)
+	tagTmpl, err := loadOptionalTemplate(cfg.TemplateEngine, tagTemplatePath)
+	if err != nil {
+		return fmt.Errorf("error parsing tag template: %w", err)
 	}
-
-	// Find unused images
-	unusedImages, err := findUnusedImages(postsData, imagesPath)
+	postTmpl, err := loadOptionalTemplate(cfg.TemplateEngine, postTemplatePath)
 	if err != nil {
-		fmt.Printf("Error finding unused images: %v\n", err)
-		return
+		return fmt.Errorf("error parsing post template: %w", err)
 	}
+	report.addStage(stageTemplateParse, parseStart)
 
-	if len(unusedImages) > 0 {
+	if len(unusedImages) > 0 && !opts.HTMLOnly && cfg.SQLite.Path != "" {
+		report.warn("%d images were not in %s", len(unusedImages), cfg.SQLite.Table)
+		if cfg.SQLite.AutoAdd {
+			for _, image := range slices.Backward(unusedImages) {
+				fmt.Printf("Adding image: %s\n", image)
+			}
+			err = insertSQLitePosts(cfg.SQLite, unusedImages)
+			if err != nil {
+				return fmt.Errorf("error adding new images to the database: %w", err)
+			}
+			postsData = withNewPosts(postsData, unusedImages)
+			fmt.Printf("Added new images to %s.\n", cfg.SQLite.Table)
+		}
+	} else if len(unusedImages) > 0 && !opts.HTMLOnly {
 		fmt.Println("Adding new images to the index json...")
-		slices.Reverse(unusedImages)
-		newPosts := make([]Post, 0)
-		for _, image := range unusedImages {
+		for _, image := range slices.Backward(unusedImages) {
 			fmt.Printf("Adding image: %s\n", image)
-			newPosts = append(newPosts, Post{
-				Title:   "New",
-				Caption: "Meaningful caption",
-				Image:   image,
-			})
 		}
-		postsData.Posts = append(newPosts, postsData.Posts...)
+		report.warn("%d images were not in index.json", len(unusedImages))
+		postsData = withNewPosts(postsData, unusedImages)
 		postsDataJSON, err := json.MarshalIndent(postsData, "", "  ")
 		if err != nil {
-			fmt.Printf("Error marshalling updated JSON data: %v\n", err)
-			return
+			return fmt.Errorf("error marshalling updated JSON data: %w", err)
+		}
+		err = os.WriteFile(indexJSONPath+".bak", byteValue, 0644)
+		if err != nil {
+			return fmt.Errorf("error backing up JSON file: %w", err)
 		}
 		err = os.WriteFile(indexJSONPath, postsDataJSON, 0644)
 		if err != nil {
-			fmt.Printf("Error writing updated JSON data to file: %v\n", err)
-			return
+			return fmt.Errorf("error writing updated JSON data to file: %w", err)
 		}
 		fmt.Println("Updated index.json with new images.")
 	}
 
-	// Execute template with the data
-	err = tmpl.Execute(outputFile, postsData)
-	if err != nil {
-		fmt.Printf("Error executing template: %v\n", err)
-		return
+	postsPath := indexJSONPath
+	if cfg.SQLite.Path != "" {
+		postsPath = cfg.SQLite.Path
+	}
+	setModTimes(postsData.Posts, imagesPath, postsPath)
+
+	// Private, draft and scheduled posts are left out of everything
+	// generated.
+	posts := publishedPosts(postsData.Posts, time.Now(), cfg.location())
+	report.Posts = len(posts)
+	setCaptionHTML(posts, captionPolicies[cfg.CaptionPolicy]())
+	setShortCaptions(posts, cfg.CaptionLength)
+	setDates(posts, cfg.location(), cfg.DateFormat)
+	if postTmpl != nil {
+		setPostURLs(posts)
+	}
+	if hidden := len(postsData.Posts) - len(posts); hidden > 0 {
+		fmt.Printf("Leaving out %d private, draft or scheduled posts.\n", hidden)
+	}
+
+	missingAlt := postsMissingAlt(posts)
+	report.missingAlt(missingAlt)
+	if opts.WarnA11y || opts.StrictA11y || opts.FailOnWarnings {
+		for _, post := range missingAlt {
+			report.warn("post %q has images without alt text: %s", post.Title, strings.Join(post.missingAltImages(), ", "))
+		}
+	}
+	if len(missingAlt) > 0 && opts.StrictA11y {
+		return fmt.Errorf("%d posts have images without alt text", len(missingAlt))
+	}
+
+	var scope map[string]bool
+	if opts.Since != "" && !opts.HTMLOnly {
+		scope, err = changedImages(opts.Since, imagesPath, posts)
+		if err != nil {
+			report.warn("can't tell what changed since %s, doing a full build: %v", opts.Since, err)
+			scope = nil
+		} else {
+			fmt.Printf("Processing %d images changed since %s.\n", len(scope), opts.Since)
+		}
+	}
+
+	if cfg.DefaultImage != "" {
+		posts = withoutMissingImages(posts, imagesPath)
 	}
 
 	// Copy and resize images
-	for _, post := range postsData.Posts {
-		srcImagePath := filepath.Join(imagesPath, post.Image)
-		dstImagePath := filepath.Join(imagesOutputDir, filepath.Base(post.Image))
+	var thumbnails map[imageSource]bool
+	if cfg.ThumbnailSize > 0 {
+		thumbnails = thumbnailSources(posts, templatesUseThumbnails(templatePath, tagTemplatePath, postTemplatePath))
+	}
+	if opts.HTMLOnly {
+		linkImages(posts, cfg, outputDir, thumbnails)
+	} else {
+		writeInlined := inlinedFilesNeeded(cfg, templatePath, tagTemplatePath, postTemplatePath)
+		buildImages(posts, cfg, imagesPath, outputDir, scope, thumbnails, writeInlined, report)
+		if opts.VerifyImages {
+			err = verifyImages(posts, cfg, outputDir, thumbnails, report)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-		if _, err := os.Stat(dstImagePath); err == nil {
-			fmt.Printf("Image %s already exists, skipping...\n", post.Image)
-			continue
+	// Images are processed once, into the first profile, and copied into
+	// the others.
+	for _, profile := range profiles {
+		if profile.OutputDir != outputDir {
+			err = syncImages(filepath.Join(outputDir, "images"), filepath.Join(profile.OutputDir, "images"))
+			if err != nil {
+				return fmt.Errorf("error copying images to %s: %w", profile.OutputDir, err)
+			}
+		}
+		if !opts.HTMLOnly && !opts.KeepEmptyDirs {
+			err = removeEmptyDirs(filepath.Join(profile.OutputDir, "images"))
+			if err != nil {
+				fmt.Printf("Error removing empty directories: %v\n", err)
+			}
+		}
+		if cfg.DefaultImage != "" {
+			err = setDefaultImage(posts, cfg.DefaultImage, profile.OutputDir)
+			if err != nil {
+				return fmt.Errorf("error copying default image: %w", err)
+			}
 		}
 
-		// Open the source image
-		srcImageFile, err := os.Open(srcImagePath)
+		profileCfg := cfg
+		profileCfg.BaseURL = profile.BaseURL
+		err = renderSite(profileCfg, profile.OutputDir, tmpl, tagTmpl, postTmpl, siteData, posts, report)
 		if err != nil {
-			fmt.Printf("Error opening source image %s: %v\n", post.Image, err)
-			continue
+			return err
+		}
+	}
+
+	fmt.Println("HTML and images have been generated successfully.")
+
+	if cfg.MaxTotalBytes > 0 {
+		for _, profile := range profiles {
+			err = checkSizeBudget(profile.OutputDir, cfg.MaxTotalBytes, cfg.BudgetAction, report)
+			if err != nil {
+				return err
+			}
 		}
-		defer srcImageFile.Close()
+	}
 
-		// Decode the image
-		img, _, err := image.Decode(srcImageFile)
+	for _, profile := range profiles {
+		err = writeManifest(profile.OutputDir)
 		if err != nil {
-			fmt.Printf("Error decoding image %s: %v\n", post.Image, err)
-			continue
+			return fmt.Errorf("error writing build manifest: %w", err)
+		}
+	}
+
+	if cfg.PostBuild != "" {
+		for _, profile := range profiles {
+			err = runPostBuild(cfg.PostBuild, profile.OutputDir)
+			if err != nil {
+				return fmt.Errorf("error running post build command: %w", err)
+			}
 		}
+	}
+	return nil
+}
+
+// renderSite renders the pages, feeds and sitemap of the site into
+// outputDir, with the base URL of cfg. Tag and post pages are skipped when
+// their template is nil. Unlisted posts only get their post page.
+func renderSite(cfg Config, outputDir string, tmpl Renderer, tagTmpl Renderer, postTmpl Renderer, siteData any, posts []Post, report *buildReport) error {
+	listed := listedPosts(posts)
+	gallery, err := imageGalleryJSONLD(listed, cfg.BaseURL)
+	if err != nil {
+		return fmt.Errorf("error generating image gallery JSON-LD: %w", err)
+	}
 
-		// Resize the image (e.g., to 800x600 for web)
-		resizedImg := resize.Resize(1440, 0, img, resize.Lanczos3)
+	// Execute template with the data
+	base := PageData{Data: siteData, Counts: postCounts(listed), AboveFold: cfg.AboveFold}
+	index := base
+	index.ImageGalleryJSONLD = gallery
+	executeStart := time.Now()
+	pageURLs, err := renderPaginated(tmpl, outputDir, "/", index, withImageSizes(listed, cfg.indexImageSizes()), cfg.PageSize)
+	if err != nil {
+		return fmt.Errorf("error executing template: %w", err)
+	}
+
+	tagURLs, err := buildTagPages(withImageSizes(listed, cfg.tagImageSizes()), base, tagTmpl, outputDir, cfg.TagPageSize)
+	if err != nil {
+		return err
+	}
+	err = buildPostPages(withImageSizes(posts, cfg.indexImageSizes()), base, postTmpl, outputDir)
+	if err != nil {
+		return err
+	}
+	report.addStage(stageTemplateExecute, executeStart)
+	pageURLs = append(pageURLs, tagURLs...)
+	pageURLs = append(pageURLs, postPageURLs(listed)...)
+
+	feedsStart := time.Now()
+	defer report.addStage(stageFeeds, feedsStart)
+	err = writeMeta(cfg, outputDir, listed, pageURLs)
+	if err != nil {
+		return err
+	}
 
-		// Save the resized image
-		dstImageFile, err := os.Create(dstImagePath)
+	if cfg.LatestCount > 0 {
+		err = writeLatestJSON(filepath.Join(outputDir, "latest.json"), cfg, listed)
 		if err != nil {
-			fmt.Printf("Error creating destination image %s: %v\n", dstImagePath, err)
-			continue
+			return fmt.Errorf("error writing latest posts: %w", err)
 		}
-		defer dstImageFile.Close()
+	}
 
-		err = jpeg.Encode(dstImageFile, resizedImg, nil)
+	if cfg.API {
+		err = writeAPI(filepath.Join(outputDir, apiDir), cfg, listed, cfg.apiPageSize())
 		if err != nil {
-			fmt.Printf("Error saving resized image %s: %v\n", dstImagePath, err)
+			return fmt.Errorf("error writing JSON API: %w", err)
 		}
+	}
+	return nil
+}
 
-		fmt.Printf("Resized image saved to %s\n", dstImagePath)
+// readPosts reads the posts from the SQLite database when one is configured,
+// and from the JSON data at indexJSONPath otherwise. The raw file contents
+// are only returned for JSON data.
+func readPosts(cfg Config, indexJSONPath string) (PostsData, []byte, error) {
+	var postsData PostsData
+	var byteValue []byte
+	var err error
+	if cfg.SQLite.Path != "" {
+		postsData, err = readSQLitePosts(cfg.SQLite)
+	} else {
+		postsData, byteValue, err = readPostsData(indexJSONPath)
+	}
+	if err != nil {
+		return postsData, byteValue, err
 	}
+	return postsData, byteValue, checkPosts(postsData.Posts)
+}
 
-	fmt.Println("HTML and images have been generated successfully.")
+// readPostsData reads and parses the JSON data at path. It also returns the
+// raw file contents.
+func readPostsData(path string) (PostsData, []byte, error) {
+	var postsData PostsData
+	jsonFile, err := os.Open(path)
+	if err != nil {
+		return postsData, nil, fmt.Errorf("error opening JSON file: %w", err)
+	}
+	defer jsonFile.Close()
+
+	byteValue, err := io.ReadAll(jsonFile)
+
+	if err != nil {
+		return postsData, nil, fmt.Errorf("error reading JSON file: %w", err)
+	}
+
+	err = json.Unmarshal(byteValue, &postsData)
+
+	if err != nil {
+		return postsData, nil, fmt.Errorf("error parsing JSON data: %w", err)
+	}
+
+	return postsData, byteValue, nil
+}
+
+// loadSiteData reads the optional site wide data file passed to templates as
+// .Data. It returns an empty object when the file does not exist, so
+// templates can look up keys either way.
+func loadSiteData(path string) (any, error) {
+	byteValue, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSON(byteValue)
+}
+
+// withNewPosts returns postsData with a post added to the front for every
+// image, newest last found first.
+func withNewPosts(postsData PostsData, images []string) PostsData {
+	newPosts := make([]Post, 0, len(images))
+	for _, image := range slices.Backward(images) {
+		newPosts = append(newPosts, Post{
+			Title:   "New",
+			Caption: "Meaningful caption",
+			Image:   image,
+		})
+	}
+	postsData.Posts = append(newPosts, postsData.Posts...)
+	return postsData
+}
+
+// showAdditions prints the posts the build would add to index.json and a
+// unified diff of the file, without writing it.
+func showAdditions(indexJSONPath string, current []byte, postsData PostsData, unusedImages []string) error {
+	if len(unusedImages) == 0 {
+		fmt.Println("No new posts would be added to the index json.")
+		return nil
+	}
+
+	proposed, err := json.MarshalIndent(withNewPosts(postsData, unusedImages), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Would add %d new posts to the index json:\n", len(unusedImages))
+	for _, image := range slices.Backward(unusedImages) {
+		fmt.Printf("  %s\n", image)
+	}
+	fmt.Println()
+	fmt.Print(unifiedDiff(indexJSONPath, indexJSONPath+" (proposed)", string(current), string(proposed)))
+	return nil
 }
 
-func findUnusedImages(postsData PostsData, imagesPath string) ([]string, error) {
+func findUnusedImages(postsData PostsData, imagesPath string, ignore []string) ([]string, error) {
 	usedImages := make(map[string]bool)
 	for _, post := range postsData.Posts {
-		usedImages[post.Image] = true
+		for _, image := range post.sources() {
+			usedImages[imagePath(image)] = true
+		}
+	}
+
+	// A project without an images directory simply has no new images.
+	if _, err := os.Stat(imagesPath); os.IsNotExist(err) {
+		return nil, nil
 	}
 
 	var unusedImages []string
@@ -196,8 +703,19 @@ func findUnusedImages(postsData PostsData, imagesPath string) ([]string, error)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && (filepath.Ext(path) == ".jpg" || filepath.Ext(path) == ".jpeg") {
-			imageName := filepath.Base(path)
+		if path != imagesPath && ignoredImage(imagesPath, path, info.IsDir(), ignore) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && (filepath.Ext(path) == ".jpg" || filepath.Ext(path) == ".jpeg" || filepath.Ext(path) == ".gif") {
+			rel, err := filepath.Rel(imagesPath, path)
+			if err != nil {
+				return err
+			}
+			// Images in album directories are referenced by their path.
+			imageName := filepath.ToSlash(rel)
 			if !usedImages[imageName] {
 				unusedImages = append(unusedImages, imageName)
 			}
@@ -211,3 +729,34 @@ func findUnusedImages(postsData PostsData, imagesPath string) ([]string, error)
 
 	return unusedImages, nil
 }
+
+// ignoredImage reports whether the scan for new images skips path. Hidden
+// files and directories are always skipped. A pattern ending with a slash
+// skips the directory with that path, any other pattern is a glob matched
+// against both the path relative to the images directory and the file name.
+func ignoredImage(imagesPath string, path string, isDir bool, ignore []string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return true
+	}
+
+	rel, err := filepath.Rel(imagesPath, path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range ignore {
+		if dir, ok := strings.CutSuffix(pattern, "/"); ok {
+			if isDir && rel == dir {
+				return true
+			}
+			continue
+		}
+		if ok, _ := pathpkg.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := pathpkg.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
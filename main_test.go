@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inTempSite changes into an empty temporary directory for the duration of
+// the test, as builds read source/ and template/ and write docs/ relative to
+// the working directory.
+func inTempSite(t *testing.T) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// writeTestFile writes contents to path, creating its directory.
+func writeTestFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the contents of the file at path.
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestBuildEmptySite(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "source/index.json", `{"posts": []}`)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}<img src="{{.ImageURL}}">{{end}}`)
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://example.com"
+
+	report, err := build(cfg, buildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Posts != 0 {
+		t.Errorf("report has %d posts, want 0", report.Posts)
+	}
+	if _, err := os.Stat("docs/index.html"); err != nil {
+		t.Errorf("index page: %v", err)
+	}
+
+	var rss struct {
+		Channel struct {
+			Items []struct{} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal([]byte(readTestFile(t, "docs/feed.xml")), &rss); err != nil {
+		t.Errorf("invalid RSS feed: %v", err)
+	} else if len(rss.Channel.Items) != 0 {
+		t.Errorf("RSS feed has %d items, want 0", len(rss.Channel.Items))
+	}
+
+	var atom struct {
+		Updated time.Time `xml:"updated"`
+		Author  string    `xml:"author>name"`
+	}
+	if err := xml.Unmarshal([]byte(readTestFile(t, "docs/atom.xml")), &atom); err != nil {
+		t.Errorf("invalid Atom feed: %v", err)
+	} else if atom.Updated.IsZero() || atom.Author == "" {
+		t.Errorf("Atom feed updated %v by %q, want the build time and an author", atom.Updated, atom.Author)
+	}
+
+	var jsonFeed struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	contents := readTestFile(t, "docs/feed.json")
+	if err := json.Unmarshal([]byte(contents), &jsonFeed); err != nil {
+		t.Errorf("invalid JSON feed: %v", err)
+	} else if jsonFeed.Items == nil || len(jsonFeed.Items) != 0 {
+		t.Errorf("JSON feed items = %v, want an empty list", jsonFeed.Items)
+	}
+
+	var sitemap struct {
+		URLs []struct {
+			Loc string `xml:"loc"`
+		} `xml:"url"`
+	}
+	if err := xml.Unmarshal([]byte(readTestFile(t, "docs/sitemap.xml")), &sitemap); err != nil {
+		t.Fatalf("invalid sitemap: %v", err)
+	}
+	if len(sitemap.URLs) != 1 || sitemap.URLs[0].Loc != "https://example.com/" {
+		t.Errorf("sitemap lists %v, want only the index", sitemap.URLs)
+	}
+}
+
+func TestAutoAddKeepsUnknownTopLevelKeys(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "source/index.json", `{
+  "meta": {"owner": "me", "n": 1.5, "tags": ["a", "b"]},
+  "posts": [{"title": "A", "caption": "a", "image": "a.jpg"}],
+  "zeta": [1, 2]
+}`)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}{{.Title}}{{end}}`)
+	writeTestJPEG(t, "source/images/a.jpg", 32, 16)
+	writeTestJPEG(t, "source/images/b.jpg", 32, 16)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 16
+
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := readTestFile(t, "source/index.json")
+	meta, postsKey, zeta := strings.Index(contents, `"meta"`), strings.Index(contents, `"posts"`), strings.Index(contents, `"zeta"`)
+	if !(meta < postsKey && postsKey < zeta) {
+		t.Errorf("keys were reordered:\n%s", contents)
+	}
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(contents), &got); err != nil {
+		t.Fatal(err)
+	}
+	var posts []Post
+	if err := json.Unmarshal(got["posts"], &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Errorf("index.json has %d posts after adding b.jpg, want 2", len(posts))
+	}
+	for key, want := range map[string]string{
+		"meta": `{"owner":"me","n":1.5,"tags":["a","b"]}`,
+		"zeta": `[1,2]`,
+	} {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, got[key]); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if compact.String() != want {
+			t.Errorf("%s = %s, want %s", key, compact.String(), want)
+		}
+	}
+}
+
+func TestFindUnusedImagesSkipsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"new.jpg", "used.jpg", "_wip/draft.jpg", "photos/keep.jpg", "photos/x.orig.jpg", ".hidden.jpg", ".cache/y.jpg"} {
+		writeTestFile(t, filepath.Join(dir, filepath.FromSlash(name)), "jpeg")
+	}
+	posts := PostsData{Posts: []Post{{Title: "Used", Image: "used.jpg"}}}
+
+	unused, err := findUnusedImages(posts, dir, []string{"_wip/", "*.orig.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"new.jpg", "photos/keep.jpg"}; !slices.Equal(unused, want) {
+		t.Errorf("unused images are %v, want %v", unused, want)
+	}
+}
+
+func TestSlugImageNaming(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "source/index.json", `{"posts": [
+  {"title": "My Post", "caption": "", "image": "DSC_0001.jpg"},
+  {"title": "My Post", "caption": "", "image": "DSC_0002.jpg"}
+]}`)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}<img src="{{.ImageURL}}">{{end}}`)
+	writeTestJPEG(t, "source/images/DSC_0001.jpg", 32, 16)
+	writeTestJPEG(t, "source/images/DSC_0002.jpg", 32, 16)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 16
+	cfg.ImageNaming = "slug"
+
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	index := readTestFile(t, "docs/index.html")
+	for _, name := range []string{"my-post.jpg", "my-post-2.jpg"} {
+		if !strings.Contains(index, `src="/images/`+name+`"`) {
+			t.Errorf("index does not reference %s:\n%s", name, index)
+		}
+		if _, err := os.Stat(filepath.Join("docs/images", name)); err != nil {
+			t.Errorf("image %s was not written: %v", name, err)
+		}
+	}
+	if _, err := os.Stat("docs/images/DSC_0001.jpg"); !os.IsNotExist(err) {
+		t.Errorf("image was also written under its source name")
+	}
+}
+
+func TestSmallImagesInlined(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "source/index.json", `{"posts": [
+  {"title": "Icon", "caption": "", "image": "icon.jpg"},
+  {"title": "Photo", "caption": "", "image": "photo.jpg?w=256"}
+]}`)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}<img src="{{.ImageEmbedURL}}">{{end}}`)
+	writeTestJPEG(t, "source/images/icon.jpg", 8, 8)
+	writeTestJPEG(t, "source/images/photo.jpg", 256, 256)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 8
+	cfg.InlineBelowBytes = 2048
+
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	index := readTestFile(t, "docs/index.html")
+	if !strings.Contains(index, `<img src="data:image/jpeg;base64,`) {
+		t.Errorf("icon is not inlined:\n%s", index)
+	}
+	if !strings.Contains(index, `<img src="/images/photo-w256.jpg">`) {
+		t.Errorf("photo is inlined:\n%s", index)
+	}
+	if _, err := os.Stat("docs/images/icon.jpg"); !os.IsNotExist(err) {
+		t.Errorf("inlined icon was written as a file")
+	}
+	if _, err := os.Stat("docs/images/photo-w256.jpg"); err != nil {
+		t.Errorf("photo was not written: %v", err)
+	}
+}
+
+func TestDefaultImageForImagelessPosts(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "source/index.json", `{"posts": [
+  {"title": "Draft", "caption": ""},
+  {"title": "Missing", "caption": "", "image": "missing.jpg"},
+  {"title": "Done", "caption": "", "image": "done.jpg"}
+]}`)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}<img src="{{.ImageURL}}" width="{{.ImageWidth}}">{{end}}`)
+	writeTestJPEG(t, "source/images/done.jpg", 32, 16)
+	writeTestJPEG(t, "placeholder.jpg", 24, 24)
+	cfg := defaultConfig()
+	cfg.ImageWidth = 16
+	cfg.DefaultImage = "placeholder.jpg"
+
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `<img src="/default-image.jpg" width="24"><img src="/default-image.jpg" width="24"><img src="/images/done.jpg" width="16">`
+	if index := readTestFile(t, "docs/index.html"); index != want {
+		t.Errorf("index is\n%s\nwant\n%s", index, want)
+	}
+	if readTestFile(t, "docs/default-image.jpg") != readTestFile(t, "placeholder.jpg") {
+		t.Errorf("the default image was not copied as is")
+	}
+}
+
+func TestPruningRemovesEmptyVariantDirs(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepEmpty bool
+	}{
+		{"pruned", false},
+		{"kept", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inTempSite(t)
+			writeTestFile(t, "template/index.html", `{{range .Posts}}{{.Title}}{{end}}`)
+			writeTestFile(t, "source/index.json", `{"posts": [{"title": "A", "caption": "", "image": "a.jpg"}]}`)
+			writeTestJPEG(t, "source/images/a.jpg", 32, 16)
+			cfg := defaultConfig()
+			cfg.ImageWidth = 16
+			cfg.ResponsiveWidths = []int{8}
+			cfg.ImageLayout = "dirs"
+
+			if _, err := build(cfg, buildOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat("docs/images/8/a.jpg"); err != nil {
+				t.Fatal(err)
+			}
+
+			// The image is deleted along with its post.
+			if err := os.Remove("source/images/a.jpg"); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, "source/index.json", `{"posts": []}`)
+			if _, err := build(cfg, buildOptions{KeepEmptyDirs: test.keepEmpty}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := os.Stat("docs/images/8")
+			if test.keepEmpty && err != nil {
+				t.Errorf("empty variant dir was removed: %v", err)
+			}
+			if !test.keepEmpty && !os.IsNotExist(err) {
+				t.Errorf("empty variant dir was kept")
+			}
+			if _, err := os.Stat("docs/images"); err != nil {
+				t.Errorf("images output dir was removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestPostVisibility(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}[{{.Title}}]{{end}}`)
+	writeTestFile(t, "template/post.html", `{{.Post.Title}}`)
+	writeTestFile(t, "source/index.json", `{"posts": [
+  {"title": "Public", "caption": "", "visibility": "public"},
+  {"title": "Unlisted", "caption": "", "visibility": "unlisted"},
+  {"title": "Private", "caption": "", "visibility": "private"}
+]}`)
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://example.com"
+
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	index := readTestFile(t, "docs/index.html")
+	sitemap := readTestFile(t, "docs/sitemap.xml")
+	feed := readTestFile(t, "docs/feed.xml")
+	tests := []struct {
+		title   string
+		slug    string
+		listed  bool
+		hasPage bool
+	}{
+		{"Public", "public", true, true},
+		{"Unlisted", "unlisted", false, true},
+		{"Private", "private", false, false},
+	}
+	for _, test := range tests {
+		if got := strings.Contains(index, "["+test.title+"]"); got != test.listed {
+			t.Errorf("%s: in the index = %v, want %v", test.title, got, test.listed)
+		}
+		if got := strings.Contains(sitemap, "/posts/"+test.slug+"/"); got != test.listed {
+			t.Errorf("%s: in the sitemap = %v, want %v", test.title, got, test.listed)
+		}
+		if got := strings.Contains(feed, test.title); got != test.listed {
+			t.Errorf("%s: in the feed = %v, want %v", test.title, got, test.listed)
+		}
+		_, err := os.Stat(filepath.Join("docs/posts", test.slug, "index.html"))
+		if got := err == nil; got != test.hasPage {
+			t.Errorf("%s: has a post page = %v, want %v", test.title, got, test.hasPage)
+		}
+	}
+
+	// Making a post private removes the page of its previous build.
+	writeTestFile(t, "source/index.json", `{"posts": [{"title": "Public", "caption": "", "visibility": "private"}]}`)
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("docs/posts/public"); !os.IsNotExist(err) {
+		t.Errorf("page of the post made private was kept")
+	}
+}
+
+func TestAboveFoldLoadingAttrs(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}<img {{.LoadingAttrs}} data-index="{{.Index}}">
+{{end}}`)
+	writeTestFile(t, "source/index.json", `{"posts": [
+  {"title": "A", "caption": ""},
+  {"title": "B", "caption": ""},
+  {"title": "C", "caption": ""},
+  {"title": "D", "caption": ""}
+]}`)
+	cfg := defaultConfig()
+	cfg.AboveFold = 2
+
+	if _, err := build(cfg, buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `<img loading="eager" fetchpriority="high" data-index="0">
+<img loading="eager" fetchpriority="high" data-index="1">
+<img loading="lazy" data-index="2">
+<img loading="lazy" data-index="3">
+`
+	if index := readTestFile(t, "docs/index.html"); index != want {
+		t.Errorf("index is\n%s\nwant\n%s", index, want)
+	}
+}
+
+func TestSrcsetDescriptors(t *testing.T) {
+	tests := []struct {
+		name       string
+		descriptor string
+		image      string
+		widths     []int
+		want       string
+		files      []string
+	}{
+		{
+			"width",
+			"width",
+			"a.jpg",
+			[]int{8},
+			`<img src="/images/a.jpg" srcset="/images/a-8.jpg 8w, /images/a.jpg 16w" sizes="50vw">`,
+			[]string{"a.jpg", "a-8.jpg"},
+		},
+		{
+			"width override among the widths",
+			"width",
+			"a.jpg?w=8",
+			[]int{4, 8, 4},
+			`<img src="/images/a-w8.jpg" srcset="/images/a-w8-4.jpg 4w, /images/a-w8.jpg 8w" sizes="50vw">`,
+			[]string{"a-w8.jpg", "a-w8-4.jpg"},
+		},
+		{
+			"density",
+			"density",
+			"a.jpg",
+			nil,
+			`<img src="/images/a.jpg" srcset="/images/a.jpg 1x, /images/a-32.jpg 2x">`,
+			[]string{"a.jpg", "a-32.jpg"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inTempSite(t)
+			writeTestFile(t, "template/index.html", `{{range .Posts}}<img src="{{.ImageURL}}" {{.ImageAttrs}}>{{end}}`)
+			writeTestFile(t, "source/index.json", `{"posts": [{"title": "A", "caption": "", "image": "`+test.image+`"}]}`)
+			writeTestJPEG(t, "source/images/a.jpg", 64, 32)
+			cfg := defaultConfig()
+			cfg.ImageWidth = 16
+			cfg.ResponsiveWidths = test.widths
+			cfg.ImageSizes = "50vw"
+			cfg.SrcsetDescriptor = test.descriptor
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := build(cfg, buildOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if index := readTestFile(t, "docs/index.html"); index != test.want {
+				t.Errorf("index is\n%s\nwant\n%s", index, test.want)
+			}
+			for _, file := range test.files {
+				if _, err := os.Stat(filepath.Join("docs/images", file)); err != nil {
+					t.Errorf("variant was not written: %v", err)
+				}
+			}
+		})
+	}
+
+	cfg := defaultConfig()
+	cfg.SrcsetDescriptor = "density"
+	cfg.ResponsiveWidths = []int{480}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("responsiveWidths are accepted with density descriptors")
+	}
+}
+
+func TestPostCountsMatchRenderedPosts(t *testing.T) {
+	inTempSite(t)
+	writeTestFile(t, "template/index.html", `{{.Counts.Total}} photos|{{range .Posts}}[{{.Title}}]{{end}}`)
+	writeTestFile(t, "template/tag.html", `{{.Counts.Tag .Tag}} in #{{.Tag}}|{{range .Posts}}[{{.Title}}]{{end}}`)
+	writeTestFile(t, "source/index.json", `{"posts": [
+  {"title": "A", "caption": "", "tags": ["sky"]},
+  {"title": "B", "caption": "", "tags": ["sky", "sea"]},
+  {"title": "C", "caption": ""},
+  {"title": "Draft", "caption": "", "tags": ["sky"], "draft": true},
+  {"title": "Unlisted", "caption": "", "tags": ["sky"], "visibility": "unlisted"},
+  {"title": "Private", "caption": "", "tags": ["sea"], "visibility": "private"},
+  {"title": "Scheduled", "caption": "", "tags": ["sky"], "date": "2999-01-01T00:00:00Z"}
+]}`)
+
+	if _, err := build(defaultConfig(), buildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	pages := map[string]string{
+		"docs/index.html":          "3 photos|[A][B][C]",
+		"docs/tags/sky/index.html": "2 in #sky|[A][B]",
+		"docs/tags/sea/index.html": "1 in #sea|[B]",
+	}
+	for path, want := range pages {
+		if got := readTestFile(t, path); got != want {
+			t.Errorf("%s is %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// manifestFile lists the files of the last build, and purgedManifestFile the
+// files as they were when the CDN was last purged. Both live in the output
+// directory.
+const (
+	manifestFile       = ".build-manifest.json"
+	purgedManifestFile = ".purged-manifest.json"
+)
+
+// buildManifest maps the files of an output directory, as slash separated
+// relative paths, to their sha256.
+type buildManifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// writeManifest writes the manifest of outputDir into it. Hidden files, like
+// the manifests and the image cache, are left out.
+func writeManifest(outputDir string) error {
+	manifest := buildManifest{Files: make(map[string]string)}
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != outputDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(path, nil)
+		if err != nil {
+			return err
+		}
+		manifest.Files[filepath.ToSlash(rel)] = hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return saveManifest(filepath.Join(outputDir, manifestFile), manifest)
+}
+
+// loadManifest reads the manifest at path. A missing manifest is empty.
+func loadManifest(path string) (buildManifest, error) {
+	manifest := buildManifest{Files: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+func saveManifest(path string, manifest buildManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// changedURLs returns the root relative URLs of the files added, modified or
+// removed between the manifests, sorted. Index pages are also listed by their
+// directory URL.
+func changedURLs(before buildManifest, after buildManifest) []string {
+	var urls []string
+	add := func(file string) {
+		urls = append(urls, "/"+file)
+		if file == "index.html" || strings.HasSuffix(file, "/index.html") {
+			urls = append(urls, "/"+strings.TrimSuffix(file, "index.html"))
+		}
+	}
+	for file, hash := range after.Files {
+		if before.Files[file] != hash {
+			add(file)
+		}
+	}
+	for file := range before.Files {
+		if _, ok := after.Files[file]; !ok {
+			add(file)
+		}
+	}
+	slices.Sort(urls)
+	return urls
+}
+
+// runPurge purges the files changed since the last purge from the CDN, for
+// every profile. The changed URLs are posted to the purge webhook, or only
+// printed with --dry-run or without a webhook.
+func runPurge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the URLs that would be purged without purging them")
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	for _, profile := range cfg.outputProfiles() {
+		current, err := loadManifest(filepath.Join(profile.OutputDir, manifestFile))
+		if err != nil {
+			return fmt.Errorf("error reading build manifest: %w", err)
+		}
+		if len(current.Files) == 0 {
+			return fmt.Errorf("no build manifest in %s, build the site first", profile.OutputDir)
+		}
+		purgedPath := filepath.Join(profile.OutputDir, purgedManifestFile)
+		purged, err := loadManifest(purgedPath)
+		if err != nil {
+			return fmt.Errorf("error reading purged manifest: %w", err)
+		}
+
+		urls := changedURLs(purged, current)
+		if profile.BaseURL != "" {
+			for i, url := range urls {
+				urls[i] = absoluteURL(profile.BaseURL, url)
+			}
+		}
+		if len(urls) == 0 {
+			fmt.Printf("Nothing changed in %s since the last purge.\n", profile.OutputDir)
+			continue
+		}
+
+		if *dryRun || cfg.PurgeWebhook == "" {
+			fmt.Printf("Would purge %d URLs of %s:\n", len(urls), profile.OutputDir)
+			for _, url := range urls {
+				fmt.Printf("  %s\n", url)
+			}
+			continue
+		}
+
+		err = callPurgeWebhook(cfg.PurgeWebhook, urls)
+		if err != nil {
+			return fmt.Errorf("error purging %s: %w", profile.OutputDir, err)
+		}
+		err = saveManifest(purgedPath, current)
+		if err != nil {
+			return fmt.Errorf("error saving purged manifest: %w", err)
+		}
+		fmt.Printf("Purged %d URLs of %s.\n", len(urls), profile.OutputDir)
+	}
+	return nil
+}
+
+// callPurgeWebhook posts the URLs to the webhook as {"urls": [...]}, with the
+// token in BRICKSLING_PURGE_TOKEN as a bearer token when set.
+func callPurgeWebhook(webhook string, urls []string) error {
+	body, err := json.Marshal(map[string][]string{"urls": urls})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("BRICKSLING_PURGE_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
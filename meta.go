@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runMeta regenerates the feeds, the sitemap and robots.txt of every profile
+// from the posts and the already generated images, without processing images,
+// rendering pages or rewriting index.json.
+func runMeta(args []string) error {
+	flags := flag.NewFlagSet("meta", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	indexJSONPath := "source/index.json"
+	postsData, _, err := readPosts(cfg, indexJSONPath)
+	if err != nil {
+		return err
+	}
+
+	postsPath := indexJSONPath
+	if cfg.SQLite.Path != "" {
+		postsPath = cfg.SQLite.Path
+	}
+	imagesPath := "source/images"
+	setModTimes(postsData.Posts, imagesPath, postsPath)
+	posts := publishedPosts(postsData.Posts, time.Now(), cfg.location())
+	setDates(posts, cfg.location(), cfg.DateFormat)
+	if _, err := os.Stat("template/post.html"); err == nil {
+		setPostURLs(posts)
+	}
+
+	// Images are linked for every published post, as the build names them,
+	// before leaving out the unlisted ones.
+	if cfg.DefaultImage != "" {
+		posts = withoutMissingImages(posts, imagesPath)
+	}
+	var thumbnails map[imageSource]bool
+	if cfg.ThumbnailSize > 0 {
+		thumbnails = thumbnailSources(posts, templatesUseThumbnails("template/index.html", "template/tag.html", "template/post.html"))
+	}
+	profiles := cfg.outputProfiles()
+	linkImages(posts, cfg, profiles[0].OutputDir, thumbnails)
+	posts = listedPosts(posts)
+
+	pageURLs := paginatedURLs(posts, "/", cfg.PageSize)
+	pageURLs = append(pageURLs, tagPageURLs(posts, "template/tag.html", cfg.TagPageSize)...)
+	pageURLs = append(pageURLs, postPageURLs(posts)...)
+	for _, profile := range profiles {
+		profileCfg := cfg
+		profileCfg.BaseURL = profile.BaseURL
+		if cfg.DefaultImage != "" {
+			err = setDefaultImage(posts, cfg.DefaultImage, profile.OutputDir)
+			if err != nil {
+				return fmt.Errorf("error copying default image: %w", err)
+			}
+		}
+		err = writeMeta(profileCfg, profile.OutputDir, posts, pageURLs)
+		if err != nil {
+			return err
+		}
+		if profile.BaseURL != "" {
+			fmt.Printf("Regenerated feeds and sitemap in %s.\n", profile.OutputDir)
+		}
+	}
+	return nil
+}
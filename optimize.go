@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// optimizeManifestFile records the images optimize has already processed, in
+// the output directory.
+const optimizeManifestFile = ".optimize-manifest.json"
+
+// optimizeSettings are the variants an optimization pass writes next to
+// every generated image: a JPEG per quality, of the JPEG and PNG images, and
+// a palette PNG per number of colors, of the PNG images.
+type optimizeSettings struct {
+	Qualities []int `json:"qualities,omitempty"`
+	PNGColors []int `json:"pngColors,omitempty"`
+}
+
+// optimizedImage is an image as optimize found it: its sha256, the settings
+// its variants were written with and the variants written, as slash
+// separated paths relative to the output directory. Variants that come out
+// no smaller than the image are not written.
+type optimizedImage struct {
+	Hash string `json:"hash"`
+	optimizeSettings
+	Variants []string `json:"variants,omitempty"`
+}
+
+// optimizedWith reports whether the image was optimized with settings.
+func (image optimizedImage) optimizedWith(settings optimizeSettings) bool {
+	return slices.Equal(image.Qualities, settings.Qualities) && slices.Equal(image.PNGColors, settings.PNGColors)
+}
+
+// optimizeManifest maps the images of the output directory, as slash
+// separated paths relative to it, to how optimize found them.
+type optimizeManifest struct {
+	Images map[string]optimizedImage `json:"images"`
+}
+
+// loadOptimizeManifest reads the optimize manifest of outputDir. A missing
+// manifest is empty.
+func loadOptimizeManifest(outputDir string) (optimizeManifest, error) {
+	manifest := optimizeManifest{Images: make(map[string]optimizedImage)}
+	data, err := os.ReadFile(filepath.Join(outputDir, optimizeManifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	if manifest.Images == nil {
+		manifest.Images = make(map[string]optimizedImage)
+	}
+	return manifest, err
+}
+
+// keepOptimizedVariants adds the optimized variants of the images in
+// produced, written into imagesOutputDir, to produced, so that builds keep
+// them. Variants of an image the build encoded again are left out and
+// removed along with the orphaned images.
+func keepOptimizedVariants(outputDir string, imagesOutputDir string, produced map[string]bool) error {
+	manifest, err := loadOptimizeManifest(outputDir)
+	if err != nil {
+		return err
+	}
+	for name, image := range manifest.Images {
+		rel := strings.TrimPrefix(name, "images/")
+		if !produced[rel] || len(image.Variants) == 0 {
+			continue
+		}
+		hash, err := hashFile(filepath.Join(imagesOutputDir, filepath.FromSlash(rel)), nil)
+		if err != nil || hash != image.Hash {
+			continue
+		}
+		for _, variant := range image.Variants {
+			produced[strings.TrimPrefix(variant, "images/")] = true
+		}
+	}
+	return nil
+}
+
+// optimizedVariantName returns the name of a variant of the image name, the
+// tag before its extension, like "images/a.q60.jpg".
+func optimizedVariantName(name string, tag string, ext string) string {
+	return strings.TrimSuffix(name, pathpkg.Ext(name)) + "." + tag + ext
+}
+
+// parseLevels parses a comma separated list of numbers between lo and hi
+// for the flag name, sorted and without repeats.
+func parseLevels(value string, name string, lo int, hi int) ([]int, error) {
+	var levels []int
+	for _, item := range splitList(value) {
+		level, err := strconv.Atoi(item)
+		if err != nil || level < lo || level > hi {
+			return nil, fmt.Errorf("--%s must be a list of numbers between %d and %d, got %q", name, lo, hi, item)
+		}
+		levels = append(levels, level)
+	}
+	slices.Sort(levels)
+	return slices.Compact(levels), nil
+}
+
+// runOptimize writes additional variants of the generated images of the
+// site next to them, without reading the sources: JPEGs at other qualities,
+// of PNGs too, and palette PNGs. The images the build generated are left as
+// they are, as are images copied verbatim by the build and images already
+// optimized with the same settings and unchanged since. The variants are
+// recorded in the optimize manifest, which keeps builds from removing them
+// until their image is encoded again, and the other profiles and the build
+// manifests are updated after.
+func runOptimize(args []string) error {
+	flags := flag.NewFlagSet("optimize", flag.ExitOnError)
+	qualities := flags.String("quality", "", "write JPEG variants at these qualities, a comma separated list of 1 to 100")
+	pngColors := flags.String("png-colors", "", "write PNG variants of the PNG images with palettes of at most these many colors, a comma separated list of 2 to 256")
+	dryRun := flags.Bool("dry-run", false, "print the variants without writing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bricksling optimize [--quality n,...] [--png-colors n,...] [--dry-run]")
+		fmt.Fprintln(flags.Output(), "\nWrites variants of the generated images next to them, like a.q60.jpg and")
+		fmt.Fprintln(flags.Output(), "a.c64.png, keeping the images themselves. Images copied verbatim by the")
+		fmt.Fprintln(flags.Output(), "build are left alone.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var settings optimizeSettings
+	var err error
+	settings.Qualities, err = parseLevels(*qualities, "quality", 1, 100)
+	if err != nil {
+		return err
+	}
+	settings.PNGColors, err = parseLevels(*pngColors, "png-colors", 2, 256)
+	if err != nil {
+		return err
+	}
+	if len(settings.Qualities) == 0 && len(settings.PNGColors) == 0 {
+		return errors.New("nothing to optimize, set --quality or --png-colors")
+	}
+
+	cfg, err := loadConfig("bricksling.json")
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	profiles := cfg.outputProfiles()
+	outputDir := profiles[0].OutputDir
+
+	background, err := parseHexColor(cfg.FlattenBackground)
+	if err != nil {
+		return fmt.Errorf("invalid flattenBackground: %w", err)
+	}
+
+	manifestPath := filepath.Join(outputDir, optimizeManifestFile)
+	manifest, err := loadOptimizeManifest(outputDir)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", manifestPath, err)
+	}
+	variants := make(map[string]bool)
+	for _, image := range manifest.Images {
+		for _, variant := range image.Variants {
+			variants[variant] = true
+		}
+	}
+
+	// Only the images of the build get variants. Copies are byte for byte
+	// the sources and stay that way.
+	cache := loadImageCache(filepath.Join(outputDir, ".image-cache.json"))
+
+	var optimized, written, skipped int
+	imagesDir := filepath.Join(outputDir, "images")
+	err = filepath.WalkDir(imagesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		entry, generated := cache.Images[strings.TrimPrefix(name, "images/")]
+		if variants[name] || !generated || entry.Copy {
+			return nil
+		}
+
+		hash, err := hashFile(path, nil)
+		if err != nil {
+			return err
+		}
+		previous := manifest.Images[name]
+		if previous.Hash == hash && previous.optimizedWith(settings) {
+			skipped++
+			return nil
+		}
+
+		names, err := optimizeImage(path, name, settings, background, cache, *dryRun)
+		if err != nil {
+			fmt.Printf("Error optimizing %s: %v\n", path, err)
+			return nil
+		}
+		optimized++
+		written += len(names)
+		if !*dryRun {
+			// Variants of a previous pass with other settings are stale.
+			for _, variant := range previous.Variants {
+				if !slices.Contains(names, variant) {
+					os.Remove(filepath.Join(outputDir, filepath.FromSlash(variant)))
+				}
+			}
+			manifest.Images[name] = optimizedImage{Hash: hash, optimizeSettings: settings, Variants: names}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Printf("Optimized %d images into %d variants. %d were already optimized.\n", optimized, written, skipped)
+	if *dryRun {
+		return nil
+	}
+
+	for name := range manifest.Images {
+		if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(name))); os.IsNotExist(err) {
+			delete(manifest.Images, name)
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(manifestPath, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, profile := range profiles {
+		if profile.OutputDir != outputDir {
+			err = syncImages(imagesDir, filepath.Join(profile.OutputDir, "images"))
+			if err != nil {
+				return fmt.Errorf("error copying images to %s: %w", profile.OutputDir, err)
+			}
+		}
+		err = writeManifest(profile.OutputDir)
+		if err != nil {
+			return fmt.Errorf("error writing build manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// optimizeImage writes the variants of the JPEG or PNG image at path, named
+// name in the output directory, that come out smaller than the image, unless
+// dryRun is set, and returns their names. JPEG variants of transparent images
+// are flattened onto background. A variant named like an image of the build
+// is skipped rather than overwrite it. Other images get no variants.
+func optimizeImage(path string, name string, settings optimizeSettings, background color.Color, cache *imageCache, dryRun bool) ([]string, error) {
+	type variant struct {
+		name   string
+		encode func(w io.Writer, img image.Image) error
+	}
+	var variants []variant
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return nil, nil
+	}
+	for _, quality := range settings.Qualities {
+		variants = append(variants, variant{
+			name: optimizedVariantName(name, fmt.Sprintf("q%d", quality), ".jpg"),
+			encode: func(w io.Writer, img image.Image) error {
+				if !isOpaque(img) {
+					img = flatten(img, background)
+				}
+				return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+			},
+		})
+	}
+	if ext == ".png" {
+		for _, colors := range settings.PNGColors {
+			variants = append(variants, variant{
+				name: optimizedVariantName(name, fmt.Sprintf("c%d", colors), ".png"),
+				encode: func(w io.Writer, img image.Image) error {
+					encoder := png.Encoder{CompressionLevel: png.BestCompression}
+					return encoder.Encode(w, quantize(img, colors))
+				},
+			})
+		}
+	}
+	if len(variants) == 0 {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeImage(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var written []string
+	for _, v := range variants {
+		if _, ok := cache.Images[strings.TrimPrefix(v.name, "images/")]; ok {
+			fmt.Printf("Skipping %s, the build writes an image with that name\n", v.name)
+			continue
+		}
+		var buf bytes.Buffer
+		err = v.encode(&buf, img)
+		if err != nil {
+			return written, err
+		}
+		if int64(buf.Len()) >= info.Size() {
+			fmt.Printf("Skipping %s, it is no smaller than %s\n", v.name, name)
+			continue
+		}
+		fmt.Printf("Optimized %s: %d bytes, %d%% of %s\n", v.name, buf.Len(), int64(buf.Len())*100/info.Size(), name)
+		if !dryRun {
+			err = writeFileAtomic(filepath.Join(filepath.Dir(path), pathpkg.Base(v.name)), func(w io.Writer) error {
+				_, err := buf.WriteTo(w)
+				return err
+			})
+			if err != nil {
+				return written, err
+			}
+		}
+		written = append(written, v.name)
+	}
+	return written, nil
+}
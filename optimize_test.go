@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestOptimizeWritesVariantsNextToImages(t *testing.T) {
+	inTempSite(t)
+	writeTestJPEG(t, "source/images/a.jpg", 64, 32)
+	writeTestFile(t, "source/index.json", `{"posts": [{"title": "A", "image": "a.jpg"}]}`)
+	writeTestFile(t, "template/index.html", `{{range .Posts}}<img src="{{.ImageURL}}">{{end}}`)
+	writeTestFile(t, "bricksling.json", `{"imageWidth": 32, "imageQuality": 95}`)
+	rebuild := func() {
+		t.Helper()
+		cfg, err := loadConfig("bricksling.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := build(cfg, buildOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rebuild()
+	original := readTestFile(t, "docs/images/a.jpg")
+	if err := runOptimize([]string{"--quality", "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, "docs/images/a.jpg") != original {
+		t.Errorf("optimize changed the image itself")
+	}
+	if _, err := decodeImage("docs/images/a.q20.jpg", nil); err != nil {
+		t.Fatalf("no variant: %v", err)
+	}
+	manifest, err := loadOptimizeManifest("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants := manifest.Images["images/a.jpg"].Variants; !slices.Equal(variants, []string{"images/a.q20.jpg"}) {
+		t.Errorf("manifest variants are %v, want images/a.q20.jpg", variants)
+	}
+
+	// The variant is not optimized in turn, and builds keep it.
+	if err := runOptimize([]string{"--quality", "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("docs/images/a.q20.q20.jpg"); !os.IsNotExist(err) {
+		t.Errorf("the variant got a variant")
+	}
+	rebuild()
+	if _, err := os.Stat("docs/images/a.q20.jpg"); err != nil {
+		t.Errorf("build removed the variant: %v", err)
+	}
+
+	// Encoding the image again leaves the variant out of date.
+	writeTestFile(t, "bricksling.json", `{"imageWidth": 32, "imageQuality": 90}`)
+	rebuild()
+	if _, err := os.Stat("docs/images/a.q20.jpg"); !os.IsNotExist(err) {
+		t.Errorf("build kept the variant of the previous image")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PageData is passed to the templates when rendering a page.
+type PageData struct {
+	Posts      []Post
+	Tag        string
+	Pagination Pagination
+	// Post is the post of a post page.
+	Post Post
+	// Data holds the contents of source/data.json, if any.
+	Data any
+	// Counts are the number of posts on the index and per tag, the same on
+	// every page.
+	Counts PostCounts
+	// AboveFold is the number of posts at the top of the page whose image
+	// loads eagerly.
+	AboveFold int
+	// ImageGalleryJSONLD is a schema.org ImageGallery script block listing
+	// every image, set on the index when baseURL is configured.
+	ImageGalleryJSONLD template.HTML
+}
+
+// Pagination describes where a page sits in a paginated list of posts.
+type Pagination struct {
+	Page       int
+	PageCount  int
+	PageSize   int
+	TotalPosts int
+	PrevURL    string
+	NextURL    string
+	Pages      []PageLink
+}
+
+// PageLink points to a single page of a paginated list.
+type PageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// postsPage is one page of a paginated list of posts.
+type postsPage struct {
+	Posts      []Post
+	Pagination Pagination
+}
+
+// paginate splits posts into pages of pageSize posts. The first page lives at
+// baseURL and the following ones at baseURL + "page/N/". A pageSize of zero
+// puts every post on a single page. An empty list still yields one page.
+func paginate(posts []Post, pageSize int, baseURL string) []postsPage {
+	if pageSize <= 0 || pageSize > len(posts) {
+		pageSize = max(len(posts), 1)
+	}
+	pageCount := max((len(posts)+pageSize-1)/pageSize, 1)
+
+	pages := make([]postsPage, 0, pageCount)
+	for i := 0; i < pageCount; i++ {
+		start := i * pageSize
+		end := min(start+pageSize, len(posts))
+
+		pagination := Pagination{
+			Page:       i + 1,
+			PageCount:  pageCount,
+			PageSize:   pageSize,
+			TotalPosts: len(posts),
+		}
+		if i > 0 {
+			pagination.PrevURL = pageURL(baseURL, i)
+		}
+		if i < pageCount-1 {
+			pagination.NextURL = pageURL(baseURL, i+2)
+		}
+		for n := 1; n <= pageCount; n++ {
+			pagination.Pages = append(pagination.Pages, PageLink{
+				Number:  n,
+				URL:     pageURL(baseURL, n),
+				Current: n == i+1,
+			})
+		}
+
+		pages = append(pages, postsPage{
+			Posts:      posts[start:end],
+			Pagination: pagination,
+		})
+	}
+
+	return pages
+}
+
+// pageURL returns the URL of page number n of a list starting at baseURL.
+func pageURL(baseURL string, n int) string {
+	if n <= 1 {
+		return baseURL
+	}
+	return fmt.Sprintf("%spage/%d/", baseURL, n)
+}
+
+// pagePath returns the output file of page number n of a list rendered into dir.
+func pagePath(dir string, n int) string {
+	if n <= 1 {
+		return filepath.Join(dir, "index.html")
+	}
+	return filepath.Join(dir, "page", fmt.Sprint(n), "index.html")
+}
+
+// renderPage executes the template into the file at path, creating its
+// directory when needed.
+func renderPage(tmpl Renderer, path string, data PageData) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	return tmpl.Render(outputFile, data)
+}
+
+// removeStaleDirs removes the directories in dir whose name is not in keep,
+// the pages left from a build with more of them, and dir itself when that
+// leaves it empty. A missing dir is left alone.
+func removeStaleDirs(dir string, keep map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || keep[entry.Name()] {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+		return os.Remove(dir)
+	}
+	return nil
+}
+
+// renderPaginated renders posts as a paginated list into dir, one file per
+// page, removing the pages left from a longer list, and returns the URLs of
+// the rendered pages. Every page gets the fields of base along with its posts,
+// positioned with base.AboveFold, and its pagination.
+func renderPaginated(tmpl Renderer, dir string, baseURL string, base PageData, posts []Post, pageSize int) ([]string, error) {
+	var urls []string
+	pages := paginate(posts, pageSize, baseURL)
+	for _, page := range pages {
+		path := pagePath(dir, page.Pagination.Page)
+		data := base
+		data.Posts = withPositions(page.Posts, base.AboveFold)
+		data.Pagination = page.Pagination
+		err := renderPage(tmpl, path, data)
+		if err != nil {
+			return urls, fmt.Errorf("%s: %w", path, err)
+		}
+		urls = append(urls, pageURL(baseURL, page.Pagination.Page))
+	}
+
+	numbers := make(map[string]bool)
+	for n := 2; n <= len(pages); n++ {
+		numbers[fmt.Sprint(n)] = true
+	}
+	err := removeStaleDirs(filepath.Join(dir, "page"), numbers)
+	if err != nil {
+		return urls, fmt.Errorf("error removing stale pages: %w", err)
+	}
+	return urls, nil
+}
+
+// paginatedURLs returns the URLs of the pages renderPaginated renders, without
+// rendering them.
+func paginatedURLs(posts []Post, baseURL string, pageSize int) []string {
+	var urls []string
+	for _, page := range paginate(posts, pageSize, baseURL) {
+		urls = append(urls, pageURL(baseURL, page.Pagination.Page))
+	}
+	return urls
+}
+
+// slugify turns s into a lowercase, URL friendly name.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
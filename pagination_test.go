@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleDirs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "page")
+	for _, name := range []string{"2", "3", "4"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "index.html"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Going from four pages to two removes pages 3 and 4.
+	if err := removeStaleDirs(dir, map[string]bool{"2": true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"2": true, "3": false, "4": false} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != want {
+			t.Errorf("page %s exists = %v, want %v", name, exists, want)
+		}
+	}
+
+	// Going down to a single page removes the page directory too.
+	if err := removeStaleDirs(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("empty page directory was kept")
+	}
+
+	if err := removeStaleDirs(dir, nil); err != nil {
+		t.Errorf("missing directory: %v", err)
+	}
+}
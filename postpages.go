@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// setPostURLs sets the URL of the page of every post, /posts/<slug>/ after
+// its title. Posts sharing a slug get a numbered suffix, in order.
+func setPostURLs(posts []Post) {
+	taken := make(map[string]bool)
+	for i := range posts {
+		slug := slugify(posts[i].Title)
+		if slug == "" {
+			slug = "post"
+		}
+		name := slug
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", slug, n)
+		}
+		taken[name] = true
+		posts[i].URL = "/posts/" + name + "/"
+	}
+}
+
+// postPageURLs returns the URLs of the pages of posts, for those that have
+// one.
+func postPageURLs(posts []Post) []string {
+	var urls []string
+	for _, post := range posts {
+		if post.URL != "" {
+			urls = append(urls, post.URL)
+		}
+	}
+	return urls
+}
+
+// buildPostPages renders a page per post into outputDir/posts using the post
+// template, removing the pages of posts that are gone or no longer public.
+// Post pages are skipped when there is no post template.
+func buildPostPages(posts []Post, base PageData, tmpl Renderer, outputDir string) error {
+	if tmpl == nil {
+		return nil
+	}
+
+	slugs := make(map[string]bool)
+	for _, post := range posts {
+		slugs[strings.TrimPrefix(strings.Trim(post.URL, "/"), "posts/")] = true
+	}
+	err := removeStaleDirs(filepath.Join(outputDir, "posts"), slugs)
+	if err != nil {
+		return fmt.Errorf("error removing stale post pages: %w", err)
+	}
+
+	for _, post := range posts {
+		path := filepath.Join(outputDir, filepath.FromSlash(strings.Trim(post.URL, "/")), "index.html")
+		data := base
+		data.Post = withPositions([]Post{post}, base.AboveFold)[0]
+		err := renderPage(tmpl, path, data)
+		if err != nil {
+			return fmt.Errorf("error rendering post page %s: %w", path, err)
+		}
+	}
+
+	fmt.Printf("Generated pages for %d posts.\n", len(posts))
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// PostImage is a gallery image of a post. In the JSON data it is either the
+// image path or an object with src, alt and caption.
+type PostImage struct {
+	Src     string `json:"src"`
+	Alt     string `json:"alt,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	// CaptionHTML is the caption as sanitized HTML and ShortCaption as text
+	// cut to captionLength, set during the build.
+	CaptionHTML  template.HTML `json:"-"`
+	ShortCaption string        `json:"-"`
+
+	// URL, Width, Height, Variants, Srcset and OriginalURL describe the
+	// generated image and are set during the build.
+	URL      string         `json:"-"`
+	Width    int            `json:"-"`
+	Height   int            `json:"-"`
+	Variants []ImageVariant `json:"-"`
+	Srcset   string         `json:"-"`
+	// Sizes is the sizes attribute going with Srcset on the page being
+	// rendered.
+	Sizes string `json:"-"`
+	// OriginalURL is the URL of the source copied as it is, if any.
+	OriginalURL string `json:"-"`
+	// EmbedURL is the URL to embed the image with in pages, a data URI for
+	// images under inlineBelowBytes.
+	EmbedURL template.URL `json:"-"`
+}
+
+// postImageObject has the JSON fields of PostImage without its methods.
+type postImageObject PostImage
+
+func (img *PostImage) UnmarshalJSON(data []byte) error {
+	var src string
+	if err := json.Unmarshal(data, &src); err == nil {
+		*img = PostImage{Src: src}
+		return nil
+	}
+	return json.Unmarshal(data, (*postImageObject)(img))
+}
+
+// MarshalJSON writes images without alt and caption back as plain paths.
+func (img PostImage) MarshalJSON() ([]byte, error) {
+	if img.Alt == "" && img.Caption == "" {
+		return json.Marshal(img.Src)
+	}
+	return json.Marshal(postImageObject(img))
+}
+
+// Params holds the free form values of a post, decoded with decodeJSON.
+type Params map[string]any
+
+func (p *Params) UnmarshalJSON(data []byte) error {
+	value, err := decodeJSON(data)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		*p = nil
+		return nil
+	}
+	params, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("params must be an object, got %s", data)
+	}
+	*p = params
+	return nil
+}
+
+// decodeJSON decodes free form JSON for templates. Objects become
+// map[string]any, arrays []any, and numbers int64 when they are whole, like
+// 1e6 or 2.0, and float64 otherwise, so that templates print 1000000 rather
+// than 1e+06.
+// Strings, booleans and null decode as usual.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return normalizeNumbers(value), nil
+}
+
+// normalizeNumbers replaces the json.Number values in value, decoded with
+// UseNumber, with an int64 or a float64.
+func normalizeNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f)
+		}
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return value
+}
+
+// dateLayouts are the accepted formats of Post.Date.
+var dateLayouts = []string{time.RFC3339, "2006-01-02"}
+
+// publishedIn returns the date of the post in loc, if it has a valid one.
+// Dates without a time of day are midnight in loc.
+func (post Post) publishedIn(loc *time.Location) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, post.Date, loc); err == nil {
+			return t.In(loc), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// namedDateFormats are the names dateFormat accepts besides Go layouts.
+var namedDateFormats = map[string]string{
+	"iso":     "2006-01-02",
+	"short":   "Jan 2, 2006",
+	"long":    "January 2, 2006",
+	"rfc3339": time.RFC3339,
+}
+
+// dateLayout returns the Go layout of a named date format, or format itself.
+func dateLayout(format string) string {
+	if layout, ok := namedDateFormats[format]; ok {
+		return layout
+	}
+	return format
+}
+
+// setDates sets the date of the posts in loc and formatted with the date
+// format, for those with a valid date.
+func setDates(posts []Post, loc *time.Location, format string) {
+	for i := range posts {
+		if t, ok := posts[i].publishedIn(loc); ok {
+			posts[i].PublishedAt = t
+			posts[i].FormattedDate = t.Format(dateLayout(format))
+		}
+	}
+}
+
+// formatDate formats t with a date format for templates, as dateFormat.
+// A zero time, for posts without a date, formats as nothing.
+func formatDate(format string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(dateLayout(format))
+}
+
+// visibilities are the accepted values of Post.Visibility.
+var visibilities = []string{"", "public", "unlisted", "private"}
+
+// status returns "private", "draft", "scheduled" for posts dated after now,
+// "unlisted" or "published". Dates without a time of day are midnight in loc.
+func (post Post) status(now time.Time, loc *time.Location) string {
+	if post.Visibility == "private" {
+		return "private"
+	}
+	if post.Draft {
+		return "draft"
+	}
+	if t, ok := post.publishedIn(loc); ok && t.After(now) {
+		return "scheduled"
+	}
+	if post.Visibility == "unlisted" {
+		return "unlisted"
+	}
+	return "published"
+}
+
+// publishedPosts returns the posts that are neither private, drafts nor
+// scheduled after now in loc, pinned posts first. Unlisted posts are included.
+func publishedPosts(posts []Post, now time.Time, loc *time.Location) []Post {
+	var published []Post
+	for _, post := range posts {
+		if status := post.status(now, loc); status == "published" || status == "unlisted" {
+			published = append(published, post)
+		}
+	}
+	return pinnedFirst(published)
+}
+
+// listedPosts returns the posts other than unlisted ones, those shown on the
+// index, the tag pages and in the feeds.
+func listedPosts(posts []Post) []Post {
+	var listed []Post
+	for _, post := range posts {
+		if post.Visibility != "unlisted" {
+			listed = append(listed, post)
+		}
+	}
+	return listed
+}
+
+// checkPosts returns an error for the first post with an unknown visibility
+// or a quality out of range.
+func checkPosts(posts []Post) error {
+	for _, post := range posts {
+		if !slices.Contains(visibilities, post.Visibility) {
+			return fmt.Errorf("post %q has unknown visibility %q", post.Title, post.Visibility)
+		}
+		if post.Quality < 0 || post.Quality > 100 {
+			return fmt.Errorf("post %q has quality %d, it must be between 1 and 100", post.Title, post.Quality)
+		}
+	}
+	return nil
+}
+
+// Pinned reports whether the post is pinned to the top.
+func (p Post) Pinned() bool {
+	return p.Pin > 0
+}
+
+// pinnedFirst moves the pinned posts to the front, the highest pin first,
+// keeping the order of the others and of posts pinned alike.
+func pinnedFirst(posts []Post) []Post {
+	slices.SortStableFunc(posts, func(a, b Post) int {
+		return max(b.Pin, 0) - max(a.Pin, 0)
+	})
+	return posts
+}
+
+// setModTimes sets the modification time of every post to the later of its
+// main image and the data file. Remote or missing images only count the data
+// file.
+func setModTimes(posts []Post, imagesPath string, dataPath string) {
+	var dataModTime time.Time
+	if info, err := os.Stat(dataPath); err == nil {
+		dataModTime = info.ModTime()
+	}
+
+	for i := range posts {
+		post := &posts[i]
+		post.ModTime = dataModTime
+		if post.Image == "" || isRemoteImage(post.Image) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(imagesPath, imagePath(post.Image))); err == nil && info.ModTime().After(post.ModTime) {
+			post.ModTime = info.ModTime()
+		}
+	}
+}
+
+// sortedByDate returns a copy of posts with the newest first, dates without a
+// time of day being midnight in loc. Posts without a valid date keep their
+// order after the dated ones.
+func sortedByDate(posts []Post, loc *time.Location) []Post {
+	sorted := slices.Clone(posts)
+	slices.SortStableFunc(sorted, func(a, b Post) int {
+		at, aok := a.publishedIn(loc)
+		bt, bok := b.publishedIn(loc)
+		switch {
+		case aok && bok:
+			return bt.Compare(at)
+		case aok:
+			return -1
+		case bok:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// sources returns the references of every image of the post, including any
+// override suffix.
+func (post Post) sources() []string {
+	var sources []string
+	if post.Image != "" {
+		sources = append(sources, post.Image)
+	}
+	for _, image := range post.Images {
+		sources = append(sources, image.Src)
+	}
+	return sources
+}
+
+// jsonField is a top level key of the JSON data and its raw value.
+type jsonField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+func (d *PostsData) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("expected a JSON object, got %v", tok)
+	}
+
+	*d = PostsData{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if key == "posts" {
+			if err := json.Unmarshal(value, &d.Posts); err != nil {
+				return err
+			}
+			value = nil
+		}
+		d.fields = append(d.fields, jsonField{Key: key, Value: value})
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func (d PostsData) MarshalJSON() ([]byte, error) {
+	fields := d.fields
+	if !slices.ContainsFunc(fields, func(f jsonField) bool { return f.Key == "posts" }) {
+		fields = append([]jsonField{{Key: "posts"}}, fields...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value := field.Value
+		if field.Key == "posts" {
+			posts := d.Posts
+			if posts == nil {
+				posts = []Post{}
+			}
+			value, err = json.Marshal(posts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGalleryImagesMixedEntries(t *testing.T) {
+	input := `{"posts": [{"title": "A", "caption": "Post caption", "image": "a.jpg", "images": [
+		"b.jpg",
+		{"src": "c.jpg", "alt": "The back", "caption": "Back"},
+		{"src": "d.jpg", "caption": "Only a caption"}
+	]}]}`
+	var data PostsData
+	if err := json.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	got := renderTestTemplate(t, `{{range .Posts}}{{range .Images}}<img src="{{.Src}}" alt="{{.AltText}}">{{end}}{{end}}`, PageData{Posts: data.Posts})
+	want := `<img src="b.jpg" alt=""><img src="c.jpg" alt="The back"><img src="d.jpg" alt="Only a caption">`
+	if got != want {
+		t.Errorf("rendered %s, want %s", got, want)
+	}
+
+	// Plain paths are written back as they were.
+	output, err := json.Marshal(data.Posts[0].Images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `["b.jpg",{"src":"c.jpg","alt":"The back","caption":"Back"},{"src":"d.jpg","caption":"Only a caption"}]`
+	if string(output) != wantJSON {
+		t.Errorf("images marshal to %s, want %s", output, wantJSON)
+	}
+}
+
+func TestParamsRenderInTemplates(t *testing.T) {
+	input := `{"title": "A", "caption": "", "params": {
+		"count": 3, "views": 1e6, "ratio": 1.5, "whole": 2.0, "big": 12345678901234,
+		"wide": true, "hidden": false, "place": "Lisbon",
+		"sizes": [1, 2.5], "camera": {"iso": 400}
+	}}`
+	var post Post
+	if err := json.Unmarshal([]byte(input), &post); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`{{.Params.count}}`, "3"},
+		{`{{.Params.views}}`, "1000000"},
+		{`{{.Params.ratio}}`, "1.5"},
+		{`{{.Params.whole}}`, "2"},
+		{`{{.Params.big}}`, "12345678901234"},
+		{`{{if .Params.wide}}wide{{end}}|{{if .Params.hidden}}hidden{{end}}`, "wide|"},
+		{`{{.Params.place}}`, "Lisbon"},
+		{`{{range .Params.sizes}}[{{.}}]{{end}}`, "[1][2.5]"},
+		{`{{.Params.camera.iso}}`, "400"},
+		{`{{if eq .Params.count 3}}three{{end}}`, "three"},
+		{`{{.Params.missing}}`, ""},
+	}
+	for _, test := range tests {
+		got := renderTestTemplate(t, `{{range .Posts}}`+test.template+`{{end}}`, PageData{Posts: []Post{post}})
+		if got != test.want {
+			t.Errorf("%s renders %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestSetDatesInTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		date   string
+		loc    *time.Location
+		format string
+		want   string
+	}{
+		{"2024-03-10T23:30:00Z", time.UTC, "Jan 2, 2006 15:04", "Mar 10, 2024 23:30"},
+		{"2024-03-10T23:30:00Z", tokyo, "Jan 2, 2006 15:04", "Mar 11, 2024 08:30"},
+		{"2024-03-10T23:30:00+01:00", tokyo, "iso", "2024-03-11"},
+		{"2024-03-10", tokyo, "rfc3339", "2024-03-10T00:00:00+09:00"},
+		{"2024-03-10", time.UTC, "long", "March 10, 2024"},
+		{"2024-03-10", time.UTC, "short", "Mar 10, 2024"},
+		{"not a date", tokyo, "iso", ""},
+		{"", tokyo, "iso", ""},
+	}
+	for _, test := range tests {
+		posts := []Post{{Date: test.date}}
+		setDates(posts, test.loc, test.format)
+		if posts[0].FormattedDate != test.want {
+			t.Errorf("%s in %s as %s is %q, want %q", test.date, test.loc, test.format, posts[0].FormattedDate, test.want)
+		}
+	}
+}
+
+func TestDateFormatTemplateFunc(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts := []Post{{Date: "2024-03-10T23:30:00Z"}, {}}
+	setDates(posts, tokyo, "short")
+
+	got := renderTestTemplate(t, `{{range .Posts}}[{{dateFormat "Mon 15:04 MST" .PublishedAt}}|{{dateFormat "iso" .PublishedAt}}]{{end}}`, PageData{Posts: posts})
+	if want := "[Mon 08:30 JST|2024-03-11][|]"; got != want {
+		t.Errorf("template renders %q, want %q", got, want)
+	}
+}
+
+func TestScheduledInTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Midnight of March 11th has passed in Tokyo but not in UTC.
+	now := time.Date(2024, 3, 10, 16, 0, 0, 0, time.UTC)
+	post := Post{Date: "2024-03-11"}
+	if status := post.status(now, tokyo); status != "published" {
+		t.Errorf("status in Tokyo is %q, want published", status)
+	}
+	if status := post.status(now, time.UTC); status != "scheduled" {
+		t.Errorf("status in UTC is %q, want scheduled", status)
+	}
+	if published := publishedPosts([]Post{post}, now, tokyo); len(published) != 1 {
+		t.Errorf("published posts in Tokyo are %v, want the post", published)
+	}
+	if published := publishedPosts([]Post{post}, now, time.UTC); len(published) != 0 {
+		t.Errorf("published posts in UTC are %v, want none", published)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"slices"
+)
+
+// colorCount is a color of an image with the number of pixels using it.
+type colorCount struct {
+	color color.NRGBA
+	count int
+}
+
+// colorBox is a group of colors of the median cut.
+type colorBox []colorCount
+
+// channel returns channel c of the color, 0 to 3 for red, green, blue and
+// alpha.
+func channel(col color.NRGBA, c int) uint8 {
+	switch c {
+	case 0:
+		return col.R
+	case 1:
+		return col.G
+	case 2:
+		return col.B
+	default:
+		return col.A
+	}
+}
+
+// widestChannel returns the channel the colors of the box spread the most
+// over, and that spread.
+func (box colorBox) widestChannel() (int, int) {
+	widest, spread := 0, -1
+	for c := 0; c < 4; c++ {
+		lo, hi := 255, 0
+		for _, cc := range box {
+			v := int(channel(cc.color, c))
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if hi-lo > spread {
+			widest, spread = c, hi-lo
+		}
+	}
+	return widest, spread
+}
+
+// average returns the color of the box weighted by the pixel counts.
+func (box colorBox) average() color.NRGBA {
+	var sum [4]int
+	total := 0
+	for _, cc := range box {
+		for c := 0; c < 4; c++ {
+			sum[c] += int(channel(cc.color, c)) * cc.count
+		}
+		total += cc.count
+	}
+	return color.NRGBA{
+		R: uint8(sum[0] / total),
+		G: uint8(sum[1] / total),
+		B: uint8(sum[2] / total),
+		A: uint8(sum[3] / total),
+	}
+}
+
+// quantize reduces img to a palette of at most n colors, chosen by median
+// cut. Images with n colors or fewer keep them exactly.
+func quantize(img image.Image, n int) *image.Paletted {
+	bounds := img.Bounds()
+	counts := make(map[color.NRGBA]int)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			counts[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)]++
+		}
+	}
+
+	colors := make(colorBox, 0, len(counts))
+	for col, count := range counts {
+		colors = append(colors, colorCount{col, count})
+	}
+	// Map iteration is random; sort so that the palette is deterministic.
+	slices.SortFunc(colors, func(a, b colorCount) int {
+		return int(a.color.R)<<24 | int(a.color.G)<<16 | int(a.color.B)<<8 | int(a.color.A) -
+			(int(b.color.R)<<24 | int(b.color.G)<<16 | int(b.color.B)<<8 | int(b.color.A))
+	})
+
+	// Split the box with the widest spread at its median pixel until there
+	// are n boxes or nothing left to split.
+	boxes := []colorBox{colors}
+	for len(boxes) < n {
+		widest, widestChannel, widestSpread := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			c, spread := box.widestChannel()
+			if spread > widestSpread {
+				widest, widestChannel, widestSpread = i, c, spread
+			}
+		}
+		if widest < 0 {
+			break
+		}
+
+		box := boxes[widest]
+		slices.SortStableFunc(box, func(a, b colorCount) int {
+			return int(channel(a.color, widestChannel)) - int(channel(b.color, widestChannel))
+		})
+		total := 0
+		for _, cc := range box {
+			total += cc.count
+		}
+		split, seen := 1, box[0].count
+		for split < len(box)-1 && seen < total/2 {
+			seen += box[split].count
+			split++
+		}
+		boxes[widest] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	index := make(map[color.NRGBA]uint8, len(colors))
+	for i, box := range boxes {
+		palette[i] = box.average()
+		for _, cc := range box {
+			index[cc.color] = uint8(i)
+		}
+	}
+
+	paletted := image.NewPaletted(bounds, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			paletted.SetColorIndex(x, y, index[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)])
+		}
+	}
+	return paletted
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/template/parse"
+)
+
+// Renderer renders pages from a parsed template.
+type Renderer interface {
+	Render(w io.Writer, data PageData) error
+}
+
+// templateEngines are the template engines, by their templateEngine name,
+// each loading a template file into a Renderer. Other engines can be
+// registered here.
+var templateEngines = map[string]func(path string) (Renderer, error){
+	"html": loadHTMLTemplate,
+}
+
+// loadOptionalTemplate loads the template at path with the template engine,
+// like the tag and post templates. It returns a nil Renderer when the
+// template does not exist.
+func loadOptionalTemplate(engine string, path string) (Renderer, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return loadTemplate(engine, path)
+}
+
+// loadTemplate loads the template at path with the named engine.
+func loadTemplate(engine string, path string) (Renderer, error) {
+	load, ok := templateEngines[engine]
+	if !ok {
+		return nil, fmt.Errorf("unknown template engine %q", engine)
+	}
+	return load(path)
+}
+
+// htmlRenderer renders html/template templates, the default engine.
+type htmlRenderer struct {
+	tmpl *template.Template
+}
+
+func loadHTMLTemplate(path string) (Renderer, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"dateFormat": formatDate,
+	}).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	return htmlRenderer{tmpl: tmpl}, nil
+}
+
+func (r htmlRenderer) Render(w io.Writer, data PageData) error {
+	return r.tmpl.Execute(w, data)
+}
+
+// templatesUseField reports whether any of the html/template templates at
+// paths reads one of the fields, as in {{.ThumbnailURL}},
+// {{$post.ThumbnailURL}} or {{(index .Images 0).ThumbnailURL}}. Missing
+// templates are skipped. A template that does not parse is taken to use
+// them all, loading it fails the build anyway.
+func templatesUseField(fields []string, paths ...string) bool {
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		tree := parse.New(filepath.Base(path))
+		tree.Mode = parse.SkipFuncCheck
+		trees := make(map[string]*parse.Tree)
+		if _, err := tree.Parse(string(contents), "", "", trees); err != nil {
+			return true
+		}
+		for _, tree := range trees {
+			if nodeUsesField(tree.Root, fields) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nodeUsesField reports whether the template node or any node below it reads
+// one of the fields.
+func nodeUsesField(node parse.Node, fields []string) bool {
+	uses := func(idents []string) bool {
+		return slices.ContainsFunc(idents, func(ident string) bool {
+			return slices.Contains(fields, ident)
+		})
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		return slices.ContainsFunc(n.Nodes, func(child parse.Node) bool {
+			return nodeUsesField(child, fields)
+		})
+	case *parse.ActionNode:
+		return nodeUsesField(n.Pipe, fields)
+	case *parse.TemplateNode:
+		return nodeUsesField(n.Pipe, fields)
+	case *parse.IfNode:
+		return nodeUsesField(&n.BranchNode, fields)
+	case *parse.RangeNode:
+		return nodeUsesField(&n.BranchNode, fields)
+	case *parse.WithNode:
+		return nodeUsesField(&n.BranchNode, fields)
+	case *parse.BranchNode:
+		return nodeUsesField(n.Pipe, fields) || nodeUsesField(n.List, fields) || nodeUsesField(n.ElseList, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		return slices.ContainsFunc(n.Cmds, func(cmd *parse.CommandNode) bool {
+			return nodeUsesField(cmd, fields)
+		})
+	case *parse.CommandNode:
+		return slices.ContainsFunc(n.Args, func(arg parse.Node) bool {
+			return nodeUsesField(arg, fields)
+		})
+	case *parse.FieldNode:
+		return uses(n.Ident)
+	case *parse.VariableNode:
+		return uses(n.Ident[1:])
+	case *parse.ChainNode:
+		return uses(n.Field) || nodeUsesField(n.Node, fields)
+	}
+	return false
+}
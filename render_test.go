@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// renderTestTemplate renders the html/template source with data.
+func renderTestTemplate(t *testing.T, source string, data PageData) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := loadHTMLTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := tmpl.Render(&b, data); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestTemplatesUseField(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{`{{range .Posts}}<img src="{{.ThumbnailURL}}">{{end}}`, true},
+		{`{{range $post := .Posts}}{{$post.ThumbnailURL}}{{end}}`, true},
+		{`{{(index .Posts 0).ThumbnailURL}}`, true},
+		{`{{define "card"}}{{.ThumbnailURL}}{{end}}{{template "card" .Post}}`, true},
+		{`{{if .Post.Date}}{{dateFormat "long" .Post.PublishedAt}}{{else}}{{.Post.ThumbnailURL}}{{end}}`, true},
+		{`{{.Post.ImageURL}}`, false},
+		{`{{/* .ThumbnailURL */}}<p>Uses .ThumbnailURL</p>`, false},
+		{`{{.ThumbnailURLs}}`, false},
+		{`{{.ThumbnailURL`, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "index.html")
+		if err := os.WriteFile(path, []byte(test.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := templatesUseField([]string{"ThumbnailURL"}, path); got != test.want {
+			t.Errorf("%s: uses .ThumbnailURL = %v, want %v", test.source, got, test.want)
+		}
+	}
+
+	if templatesUseField([]string{"ThumbnailURL"}, filepath.Join(t.TempDir(), "missing.html")) {
+		t.Errorf("missing template uses .ThumbnailURL")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build stages timed by the report. The image stages add up the time spent on
+// every image across all workers, so together they can exceed the duration of
+// the build.
+const (
+	stageLoad            = "load"
+	stageTemplateParse   = "templateParse"
+	stageTemplateExecute = "templateExecute"
+	stageImageDecode     = "imageDecode"
+	stageImageResize     = "imageResize"
+	stageImageEncode     = "imageEncode"
+	stageFeeds           = "feeds"
+)
+
+// buildStages lists the stages in the order they are printed.
+var buildStages = []string{
+	stageLoad,
+	stageTemplateParse,
+	stageTemplateExecute,
+	stageImageDecode,
+	stageImageResize,
+	stageImageEncode,
+	stageFeeds,
+}
+
+// buildReport summarizes a build for --summary-json.
+type buildReport struct {
+	mu sync.Mutex
+
+	Posts           int      `json:"posts"`
+	ImagesProcessed int      `json:"imagesProcessed"`
+	ImagesSkipped   int      `json:"imagesSkipped"`
+	ImagesFailed    int      `json:"imagesFailed"`
+	MissingAlt      int      `json:"missingAlt"`
+	MissingAltPosts []string `json:"missingAltPosts"`
+	Warnings        []string `json:"warnings"`
+	TotalBytes      int64    `json:"totalBytes"`
+	DurationMs      int64    `json:"durationMs"`
+	Errors          []string `json:"errors"`
+
+	// StagesMs is the time spent in each build stage, in milliseconds.
+	StagesMs map[string]float64 `json:"stagesMs"`
+
+	stages map[string]time.Duration
+}
+
+func newBuildReport() *buildReport {
+	return &buildReport{
+		MissingAltPosts: []string{},
+		Warnings:        []string{},
+		Errors:          []string{},
+		StagesMs:        map[string]float64{},
+		stages:          map[string]time.Duration{},
+	}
+}
+
+// addStage adds the time since start to a build stage. It is safe to call
+// from the image workers.
+func (r *buildReport) addStage(stage string, start time.Time) {
+	elapsed := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stages[stage] += elapsed
+}
+
+func (r *buildReport) imageProcessed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ImagesProcessed++
+}
+
+func (r *buildReport) imageSkipped() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ImagesSkipped++
+}
+
+// imageFailed counts a failed image and records the error.
+func (r *buildReport) imageFailed(src string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ImagesFailed++
+	r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", src, err))
+}
+
+// warn prints a warning and records it.
+func (r *buildReport) warn(format string, args ...any) {
+	warning := fmt.Sprintf(format, args...)
+	fmt.Printf("Warning: %s\n", warning)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, warning)
+}
+
+// warningCount returns the number of warnings, failed images included.
+func (r *buildReport) warningCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Warnings) + r.ImagesFailed
+}
+
+// missingAlt records the posts with images missing alt text.
+func (r *buildReport) missingAlt(posts []Post) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.MissingAlt = len(posts)
+	for _, post := range posts {
+		r.MissingAltPosts = append(r.MissingAltPosts, post.Title)
+	}
+}
+
+// finish records the duration, the output size and the error failing the
+// build, if any.
+func (r *buildReport) finish(start time.Time, outputDir string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DurationMs = time.Since(start).Milliseconds()
+	r.TotalBytes = dirSize(outputDir)
+	for stage, elapsed := range r.stages {
+		r.StagesMs[stage] = math.Round(float64(elapsed.Microseconds())/10) / 100
+	}
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// stageSummary returns the timed stages on a single line, like
+// "load 1.2ms, templateParse 0.3ms".
+func (r *buildReport) stageSummary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var stages []string
+	for _, stage := range buildStages {
+		if ms, ok := r.StagesMs[stage]; ok {
+			stages = append(stages, fmt.Sprintf("%s %gms", stage, ms))
+		}
+	}
+	return strings.Join(stages, ", ")
+}
+
+// write prints the report as a single JSON object.
+func (r *buildReport) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	output, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(output))
+	return err
+}
+
+// checkSizeBudget compares the size of outputDir with the budget, warning or
+// failing depending on action when it is exceeded.
+func checkSizeBudget(outputDir string, budget int64, action string, report *buildReport) error {
+	images := dirSize(filepath.Join(outputDir, "images"))
+	total := dirSize(outputDir)
+	if total <= budget {
+		fmt.Printf("%s is %d bytes, within the budget of %d bytes.\n", outputDir, total, budget)
+		return nil
+	}
+
+	message := fmt.Sprintf("%s is %d bytes, over the budget of %d bytes: %d bytes of images and %d bytes of pages and other files",
+		outputDir, total, budget, images, total-images)
+	if action == "fail" {
+		return errors.New(message)
+	}
+	report.warn("%s", message)
+	return nil
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
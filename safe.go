@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// html/template escapes everything it is given, except values typed as
+// template.HTML, template.HTMLAttr or template.URL. Every such value is built
+// in this file, from generated data or sanitized input, so that untrusted
+// post data can't inject markup.
+
+// captionPolicies are the sanitizer policies for caption HTML, by their
+// captionPolicy name.
+var captionPolicies = map[string]func() *bluemonday.Policy{
+	"strict": bluemonday.StrictPolicy,
+	"basic":  basicCaptionPolicy,
+	"ugc":    bluemonday.UGCPolicy,
+}
+
+// basicCaptionPolicy allows inline text formatting and links.
+func basicCaptionPolicy() *bluemonday.Policy {
+	policy := bluemonday.NewPolicy()
+	policy.AllowElements("b", "strong", "i", "em", "u", "s", "small", "sub", "sup", "code", "br")
+	policy.AllowAttrs("href").OnElements("a")
+	policy.AllowStandardURLs()
+	policy.RequireNoFollowOnLinks(true)
+	return policy
+}
+
+// setCaptionHTML sets the caption HTML of the posts and their gallery images,
+// sanitized with the policy.
+func setCaptionHTML(posts []Post, policy *bluemonday.Policy) {
+	for i := range posts {
+		post := &posts[i]
+		post.CaptionHTML = sanitizedHTML(policy, post.Caption)
+		for j := range post.Images {
+			post.Images[j].CaptionHTML = sanitizedHTML(policy, post.Images[j].Caption)
+		}
+	}
+}
+
+// setShortCaptions sets the short captions of the posts and their gallery
+// images, cut to length characters. Zero keeps them whole.
+func setShortCaptions(posts []Post, length int) {
+	for i := range posts {
+		post := &posts[i]
+		post.ShortCaption = truncateText(captionText(post.Caption), length)
+		for j := range post.Images {
+			post.Images[j].ShortCaption = truncateText(captionText(post.Images[j].Caption), length)
+		}
+	}
+}
+
+// captionText returns the text of a caption that may hold HTML, without the
+// tags.
+func captionText(caption string) string {
+	return html.UnescapeString(bluemonday.StrictPolicy().Sanitize(caption))
+}
+
+// truncateText cuts s to at most length characters at a word boundary,
+// ending it with an ellipsis when anything was cut. A single word longer than
+// length is cut within it. Zero leaves s whole.
+func truncateText(s string, length int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if length <= 0 || len(runes) <= length {
+		return s
+	}
+
+	cut := string(runes[:length])
+	if runes[length] != ' ' {
+		if i := strings.LastIndex(cut, " "); i > 0 {
+			cut = cut[:i]
+		}
+	}
+	return strings.TrimRight(cut, " .,;:!?") + "…"
+}
+
+// sanitizedHTML returns s with everything the policy doesn't allow removed.
+func sanitizedHTML(policy *bluemonday.Policy, s string) template.HTML {
+	return template.HTML(policy.Sanitize(s))
+}
+
+// jsonLDScript returns a JSON-LD script element holding v. json.Marshal
+// escapes <, > and &, so the output can't close the script element early.
+func jsonLDScript(v any) (template.HTML, error) {
+	output, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`<script type="application/ld+json">` + string(output) + `</script>`), nil
+}
+
+// responsiveAttrs returns the srcset and sizes attributes, escaped, or
+// nothing when there is no srcset.
+func responsiveAttrs(srcset string, sizes string) template.HTMLAttr {
+	if srcset == "" {
+		return ""
+	}
+	attrs := fmt.Sprintf(`srcset="%s"`, html.EscapeString(srcset))
+	if sizes != "" {
+		attrs += fmt.Sprintf(` sizes="%s"`, html.EscapeString(sizes))
+	}
+	return template.HTMLAttr(attrs)
+}
+
+// loadingAttrs returns the loading attributes of an image, eager with a
+// high fetch priority above the fold and lazy below it.
+func loadingAttrs(aboveFold bool) template.HTMLAttr {
+	if aboveFold {
+		return `loading="eager" fetchpriority="high"`
+	}
+	return `loading="lazy"`
+}
+
+// dataURL returns a data URI holding contents.
+func dataURL(mediaType string, contents []byte) template.URL {
+	return template.URL("data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(contents))
+}
+
+// imageURL returns an image URL for pages. Only root relative and http(s)
+// URLs are trusted, anything else is dropped.
+func imageURL(url string) template.URL {
+	if (strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//")) || isRemoteImage(url) {
+		return template.URL(url)
+	}
+	return ""
+}
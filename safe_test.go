@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestSanitizedHTMLPolicies(t *testing.T) {
+	const caption = `<b>bold</b> <em>em</em><script>alert(1)</script>` +
+		`<img src=x onerror="alert(1)"><a href="javascript:alert(1)">link</a>`
+	keepsFormatting := map[string]bool{"strict": false, "basic": true, "ugc": true}
+	for name, policy := range captionPolicies {
+		t.Run(name, func(t *testing.T) {
+			got := string(sanitizedHTML(policy(), caption))
+			for _, unsafe := range []string{"<script", "alert(1)", "onerror", "javascript:"} {
+				if strings.Contains(got, unsafe) {
+					t.Errorf("sanitized caption keeps %q: %s", unsafe, got)
+				}
+			}
+			if keepsFormatting[name] && !strings.Contains(got, "<b>bold</b> <em>em</em>") {
+				t.Errorf("sanitized caption lost its formatting: %s", got)
+			}
+			if !keepsFormatting[name] && (strings.Contains(got, "<") || !strings.Contains(got, "bold em")) {
+				t.Errorf("sanitized caption is not plain text: %s", got)
+			}
+		})
+	}
+}
+
+func TestResponsiveAttrs(t *testing.T) {
+	tests := []struct {
+		srcset string
+		sizes  string
+		want   template.HTMLAttr
+	}{
+		{"", "100vw", ""},
+		{"/a-16.jpg 16w, /a.jpg 32w", "", `srcset="/a-16.jpg 16w, /a.jpg 32w"`},
+		{"/a-16.jpg 16w", "(min-width: 40em) 50vw", `srcset="/a-16.jpg 16w" sizes="(min-width: 40em) 50vw"`},
+		{`/a.jpg" onload="alert(1) 16w`, `"><script>`, `srcset="/a.jpg&#34; onload=&#34;alert(1) 16w" sizes="&#34;&gt;&lt;script&gt;"`},
+	}
+	for _, test := range tests {
+		if got := responsiveAttrs(test.srcset, test.sizes); got != test.want {
+			t.Errorf("responsiveAttrs(%q, %q) = %s, want %s", test.srcset, test.sizes, got, test.want)
+		}
+	}
+}
+
+func TestImageURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want template.URL
+	}{
+		{"/images/a.jpg", "/images/a.jpg"},
+		{"https://cdn.example.com/a.jpg", "https://cdn.example.com/a.jpg"},
+		{"http://cdn.example.com/a.jpg", "http://cdn.example.com/a.jpg"},
+		{"//evil.example.com/a.jpg", ""},
+		{"javascript:alert(1)", ""},
+		{"data:text/html,<script>", ""},
+		{"images/a.jpg", ""},
+	}
+	for _, test := range tests {
+		if got := imageURL(test.url); got != test.want {
+			t.Errorf("imageURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestJSONLDScriptCantCloseScript(t *testing.T) {
+	got, err := jsonLDScript(map[string]string{"name": `</script><script>alert(1)</script>`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := strings.TrimSuffix(strings.TrimPrefix(string(got), `<script type="application/ld+json">`), `</script>`)
+	if strings.Contains(inner, "<") || strings.Contains(inner, ">") {
+		t.Errorf("JSON-LD holds markup: %s", got)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(inner), &decoded); err != nil {
+		t.Fatalf("invalid JSON-LD: %v", err)
+	}
+	if want := `</script><script>alert(1)</script>`; decoded["name"] != want {
+		t.Errorf("name is %q, want %q", decoded["name"], want)
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		s      string
+		length int
+		want   string
+	}{
+		{"a short caption", 0, "a short caption"},
+		{"a short caption", 15, "a short caption"},
+		{"a short caption", 10, "a short…"},
+		{"a short caption", 7, "a short…"},
+		{"a short caption", 8, "a short…"},
+		{"ends, with. punctuation", 11, "ends, with…"},
+		{"unbreakable", 6, "unbrea…"},
+		{"  spread \n out  words ", 10, "spread out…"},
+		{"ünïcödé wörds", 9, "ünïcödé…"},
+	}
+	for _, test := range tests {
+		if got := truncateText(test.s, test.length); got != test.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", test.s, test.length, got, test.want)
+		}
+	}
+}
+
+func TestShortCaptionsKeepFullCaption(t *testing.T) {
+	caption := `A <a href="https://example.com/a-long-link">very long link</a> and <b>bold &amp; words</b>`
+	posts := []Post{{Caption: caption, Images: []PostImage{{Caption: "<i>one two three four five six</i>"}}}}
+	setShortCaptions(posts, 20)
+
+	if want := "A very long link and…"; posts[0].ShortCaption != want {
+		t.Errorf("short caption = %q, want %q", posts[0].ShortCaption, want)
+	}
+	if posts[0].Caption != caption {
+		t.Errorf("caption was changed to %q", posts[0].Caption)
+	}
+	if want := "one two three four…"; posts[0].Images[0].ShortCaption != want {
+		t.Errorf("gallery short caption = %q, want %q", posts[0].Images[0].ShortCaption, want)
+	}
+}
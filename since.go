@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var sinceLayouts = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"}
+
+// changedImages returns the images of posts whose source changed since the
+// given point, which is either a time (RFC 3339, "2006-01-02 15:04",
+// "2006-01-02" or a duration like "24h" back from now) or a git ref.
+func changedImages(since string, imagesPath string, posts []Post) (map[string]bool, error) {
+	if t, ok := parseSinceTime(since); ok {
+		return imagesModifiedSince(t, imagesPath, posts)
+	}
+	return imagesChangedSinceRef(since, imagesPath)
+}
+
+func parseSinceTime(since string) (time.Time, bool) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), true
+	}
+	for _, layout := range sinceLayouts {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// imagesModifiedSince returns the images of posts modified after t.
+func imagesModifiedSince(t time.Time, imagesPath string, posts []Post) (map[string]bool, error) {
+	changed := make(map[string]bool)
+	for _, post := range posts {
+		for _, ref := range post.sources() {
+			image := imagePath(ref)
+			if isRemoteImage(image) {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(imagesPath, image))
+			if err != nil {
+				return nil, err
+			}
+			if info.ModTime().After(t) {
+				changed[image] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// imagesChangedSinceRef returns the images changed in the working tree since
+// the git ref, including untracked ones.
+func imagesChangedSinceRef(ref string, imagesPath string) (map[string]bool, error) {
+	diff, err := exec.Command("git", "diff", "--name-only", "--relative", ref, "--", imagesPath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff %s: %w", ref, err)
+	}
+	untracked, err := exec.Command("git", "ls-files", "--others", "--exclude-standard", "--", imagesPath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %w", err)
+	}
+
+	changed := make(map[string]bool)
+	for _, path := range strings.Fields(string(diff) + string(untracked)) {
+		rel, err := filepath.Rel(imagesPath, path)
+		if err != nil {
+			continue
+		}
+		changed[filepath.ToSlash(rel)] = true
+	}
+	return changed, nil
+}
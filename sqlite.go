@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteFields are the post fields that can be read from a database column.
+// Tags are comma separated, and images either comma separated or a JSON
+// array like in index.json.
+var sqliteFields = []string{"title", "caption", "image", "alt", "tags", "images", "date", "draft", "pin", "visibility", "params", "quality"}
+
+// column returns the column the post field is read from.
+func (src SQLiteSource) column(field string) string {
+	if column, ok := src.Columns[field]; ok {
+		return column
+	}
+	return field
+}
+
+// quoteIdentifier quotes a table or column name for SQL.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// openSQLite opens the database at path, which has to exist already.
+func openSQLite(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	return db, nil
+}
+
+// tableColumns returns the names of the columns of table.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + quoteIdentifier(table) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no table %q", table)
+	}
+	return columns, rows.Err()
+}
+
+// readSQLitePosts reads the posts from the configured table. Fields without a
+// column are left empty, except for the title and the image which are
+// required.
+func readSQLitePosts(src SQLiteSource) (PostsData, error) {
+	var postsData PostsData
+	db, err := openSQLite(src.Path)
+	if err != nil {
+		return postsData, err
+	}
+	defer db.Close()
+
+	columns, err := tableColumns(db, src.Table)
+	if err != nil {
+		return postsData, fmt.Errorf("error reading table %s: %w", src.Table, err)
+	}
+	var fields, selected []string
+	for _, field := range sqliteFields {
+		if columns[src.column(field)] {
+			fields = append(fields, field)
+			selected = append(selected, quoteIdentifier(src.column(field)))
+		}
+	}
+	for _, field := range []string{"title", "image"} {
+		if !slices.Contains(fields, field) {
+			return postsData, fmt.Errorf("table %s has no %s column %q", src.Table, field, src.column(field))
+		}
+	}
+
+	query := "SELECT " + strings.Join(selected, ", ") + " FROM " + quoteIdentifier(src.Table)
+	if src.OrderBy != "" {
+		query += " ORDER BY " + src.OrderBy
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return postsData, fmt.Errorf("error querying posts: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		values := make([]sql.NullString, len(fields))
+		dest := make([]any, len(fields))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return postsData, fmt.Errorf("error reading post: %w", err)
+		}
+
+		var post Post
+		for i, field := range fields {
+			if err := setPostField(&post, field, values[i].String); err != nil {
+				return postsData, fmt.Errorf("error reading %s of post %q: %w", field, post.Title, err)
+			}
+		}
+		postsData.Posts = append(postsData.Posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return postsData, fmt.Errorf("error reading posts: %w", err)
+	}
+	return postsData, nil
+}
+
+// setPostField sets a field of the post from the value of its column.
+func setPostField(post *Post, field string, value string) error {
+	switch field {
+	case "title":
+		post.Title = value
+	case "caption":
+		post.Caption = value
+	case "image":
+		post.Image = value
+	case "alt":
+		post.Alt = value
+	case "date":
+		post.Date = value
+	case "visibility":
+		post.Visibility = value
+	case "params":
+		if value != "" {
+			return json.Unmarshal([]byte(value), &post.Params)
+		}
+	case "draft":
+		post.Draft = value == "1" || strings.EqualFold(value, "true")
+	case "quality":
+		if value != "" {
+			quality, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			post.Quality = quality
+		}
+	case "pin":
+		if value != "" {
+			pin, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			post.Pin = pin
+		}
+	case "tags":
+		post.Tags = splitList(value)
+	case "images":
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			return json.Unmarshal([]byte(value), &post.Images)
+		}
+		for _, src := range splitList(value) {
+			post.Images = append(post.Images, PostImage{Src: src})
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// insertSQLitePosts adds a post for each new image to the table, like
+// withNewPosts does for index.json.
+func insertSQLitePosts(src SQLiteSource, images []string) error {
+	db, err := openSQLite(src.Path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	columns, err := tableColumns(db, src.Table)
+	if err != nil {
+		return err
+	}
+	inserted := []string{quoteIdentifier(src.column("title")), quoteIdentifier(src.column("image"))}
+	if columns[src.column("caption")] {
+		inserted = append(inserted, quoteIdentifier(src.column("caption")))
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)", quoteIdentifier(src.Table),
+		strings.Join(inserted, ", "), strings.Repeat(", ?", len(inserted)-1))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, image := range slices.Backward(images) {
+		args := []any{"New", image, "Meaningful caption"}
+		if _, err := tx.Exec(query, args[:len(inserted)]...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// showSQLiteAdditions prints the posts the build would add to the table,
+// without adding them.
+func showSQLiteAdditions(src SQLiteSource, unusedImages []string) {
+	if len(unusedImages) == 0 {
+		fmt.Printf("No new posts would be added to %s.\n", src.Table)
+		return
+	}
+	if !src.AutoAdd {
+		fmt.Printf("%d images are not in %s, they are not added as autoAdd is off:\n", len(unusedImages), src.Table)
+	} else {
+		fmt.Printf("Would add %d new posts to %s:\n", len(unusedImages), src.Table)
+	}
+	for _, image := range slices.Backward(unusedImages) {
+		fmt.Printf("  %s\n", image)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// postsByTag groups posts by tag slug, keeping the order of the posts. The
+// returned slugs are in order of first appearance, and names maps each slug
+// to the tag as first written.
+func postsByTag(posts []Post) (slugs []string, names map[string]string, tagged map[string][]Post) {
+	names = make(map[string]string)
+	tagged = make(map[string][]Post)
+	for _, post := range posts {
+		seen := make(map[string]bool)
+		for _, tag := range post.Tags {
+			slug := slugify(tag)
+			if slug == "" || seen[slug] {
+				continue
+			}
+			seen[slug] = true
+			if _, ok := names[slug]; !ok {
+				names[slug] = tag
+				slugs = append(slugs, slug)
+			}
+			tagged[slug] = append(tagged[slug], post)
+		}
+	}
+	return slugs, names, tagged
+}
+
+// PostCounts counts the posts shown on the index and tag pages.
+type PostCounts struct {
+	Total int
+	// Tags are the tags with their number of posts, in order of first
+	// appearance.
+	Tags []TagCount
+}
+
+// TagCount is a tag and its number of posts.
+type TagCount struct {
+	Name  string
+	Slug  string
+	Count int
+}
+
+// Tag returns the number of posts with the tag, matched like tag pages are,
+// so that {{.Counts.Tag .Tag}} works on tag pages.
+func (c PostCounts) Tag(tag string) int {
+	for _, count := range c.Tags {
+		if count.Slug == slugify(tag) {
+			return count.Count
+		}
+	}
+	return 0
+}
+
+// postCounts counts posts in total and per tag.
+func postCounts(posts []Post) PostCounts {
+	counts := PostCounts{Total: len(posts), Tags: []TagCount{}}
+	slugs, names, tagged := postsByTag(posts)
+	for _, slug := range slugs {
+		counts.Tags = append(counts.Tags, TagCount{Name: names[slug], Slug: slug, Count: len(tagged[slug])})
+	}
+	return counts
+}
+
+// tagPageURLs returns the URLs of the pages buildTagPages renders, without
+// rendering them.
+func tagPageURLs(posts []Post, tagTemplatePath string, pageSize int) []string {
+	if _, err := os.Stat(tagTemplatePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	var urls []string
+	slugs, _, tagged := postsByTag(posts)
+	for _, slug := range slugs {
+		urls = append(urls, paginatedURLs(tagged[slug], "/tags/"+slug+"/", pageSize)...)
+	}
+	return urls
+}
+
+// buildTagPages renders a paginated page per tag into outputDir/tags using the
+// tag template, removing the pages of tags no post has any more, and returns
+// the URLs of the rendered pages. Tag pages are skipped when there is no tag
+// template.
+func buildTagPages(posts []Post, base PageData, tmpl Renderer, outputDir string, pageSize int) ([]string, error) {
+	if tmpl == nil {
+		return nil, nil
+	}
+
+	var urls []string
+	slugs, names, tagged := postsByTag(posts)
+	current := make(map[string]bool)
+	for _, slug := range slugs {
+		current[slug] = true
+	}
+	err := removeStaleDirs(filepath.Join(outputDir, "tags"), current)
+	if err != nil {
+		return nil, fmt.Errorf("error removing stale tag pages: %w", err)
+	}
+	for _, slug := range slugs {
+		dir := filepath.Join(outputDir, "tags", slug)
+		baseURL := "/tags/" + slug + "/"
+		data := base
+		data.Tag = names[slug]
+		pageURLs, err := renderPaginated(tmpl, dir, baseURL, data, tagged[slug], pageSize)
+		if err != nil {
+			return urls, fmt.Errorf("error rendering tag page: %w", err)
+		}
+		urls = append(urls, pageURLs...)
+	}
+
+	fmt.Printf("Generated pages for %d tags.\n", len(slugs))
+	return urls, nil
+}
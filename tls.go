@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serveAutocert serves handler over HTTPS on :443 with certificates from
+// Let's Encrypt for the configured domains. Port 80 answers the ACME HTTP
+// challenges and redirects everything else to HTTPS.
+func serveAutocert(cfg AutocertConfig, handler http.Handler) error {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		log.Println("Redirecting HTTP to HTTPS at :80")
+		errs <- newPublicServer(":80", manager.HTTPHandler(nil)).ListenAndServe()
+	}()
+	go func() {
+		server := newPublicServer(":443", handler)
+		server.TLSConfig = manager.TLSConfig()
+		log.Printf("Server starting at :443 for %v", cfg.Domains)
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+
+	// Either server stopping takes the other down with it.
+	return fmt.Errorf("server failed to start: %w", <-errs)
+}
+
+// newPublicServer returns a server for addr with timeouts, so clients on
+// the internet can't hold connections open forever. Writes have none, large
+// images take long to download over slow connections.
+func newPublicServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// publicFileServer serves the site in dir without its dot files, like the
+// build caches and manifests, and without directory listings: directories
+// are served only through their index.html.
+func publicFileServer(dir string) http.Handler {
+	files := http.FileServer(publicDir{http.Dir(dir)})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// publicDir is a file system where directories without an index.html don't
+// exist.
+type publicDir struct {
+	http.Dir
+}
+
+func (d publicDir) Open(name string) (http.File, error) {
+	file, err := d.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := d.Dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			file.Close()
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fs.ErrNotExist
+			}
+			return nil, err
+		}
+		index.Close()
+	}
+	return file, nil
+}
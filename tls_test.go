@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublicFileServerHidesDotFilesAndListings(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "index.html"), "home")
+	writeTestFile(t, filepath.Join(dir, "posts/a/index.html"), "post")
+	writeTestFile(t, filepath.Join(dir, "images/a.jpg"), "jpeg")
+	writeTestFile(t, filepath.Join(dir, ".image-cache.json"), "{}")
+	writeTestFile(t, filepath.Join(dir, "images/.a.jpg.tmp"), "partial")
+	server := publicFileServer(dir)
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/", http.StatusOK},
+		{"/posts/a/", http.StatusOK},
+		{"/images/a.jpg", http.StatusOK},
+		{"/images/", http.StatusNotFound},
+		{"/posts/", http.StatusNotFound},
+		{"/.image-cache.json", http.StatusNotFound},
+		{"/images/.a.jpg.tmp", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", test.path, nil))
+		if recorder.Code != test.code {
+			t.Errorf("%s: status %d, want %d", test.path, recorder.Code, test.code)
+		}
+	}
+}
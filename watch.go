@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchScopes are the paths watched for each watch scope.
+var watchScopes = map[string][]string{
+	"template": {"template"},
+	"data":     {"source/index.json", "source/data.json"},
+	"images":   {"source/images"},
+}
+
+// watchInterval is how often the watched paths are checked for changes, and
+// watchDebounce how long they have to stay unchanged before a rebuild.
+const (
+	watchInterval = 500 * time.Millisecond
+	watchDebounce = 300 * time.Millisecond
+)
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// watchPaths returns the paths watched for the scope, "all" watching them all.
+func watchPaths(scope string) []string {
+	if scope != "all" {
+		return watchScopes[scope]
+	}
+	var paths []string
+	for _, name := range []string{"template", "data", "images"} {
+		paths = append(paths, watchScopes[name]...)
+	}
+	return paths
+}
+
+// snapshot returns the stamp of every file under paths. Missing paths are
+// left out.
+func snapshot(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			stamps[path] = fileStamp{ModTime: info.ModTime(), Size: info.Size()}
+			return nil
+		})
+	}
+	return stamps
+}
+
+// changedFiles returns the files added, removed or modified between snapshots.
+func changedFiles(before map[string]fileStamp, after map[string]fileStamp) []string {
+	var changed []string
+	for path, stamp := range after {
+		if before[path] != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// watchedPaths returns the paths watched for the scope with cfg, including
+// the posts database when there is one.
+func watchedPaths(cfg Config, scope string) []string {
+	paths := watchPaths(scope)
+	if cfg.SQLite.Path != "" && (scope == "all" || scope == "data") {
+		paths = append(paths, cfg.SQLite.Path)
+	}
+	return paths
+}
+
+// watchChanges calls onChange with the changed files whenever files under
+// paths change. It waits until nothing changed for watchDebounce first, so
+// that a burst of saves is handled once.
+func watchChanges(paths []string, onChange func(changed []string)) {
+	stamps := snapshot(paths)
+	for {
+		time.Sleep(watchInterval)
+		current := snapshot(paths)
+		if len(changedFiles(stamps, current)) == 0 {
+			continue
+		}
+		for {
+			time.Sleep(watchDebounce)
+			next := snapshot(paths)
+			if len(changedFiles(current, next)) == 0 {
+				break
+			}
+			current = next
+		}
+
+		if changed := changedFiles(stamps, current); len(changed) > 0 {
+			onChange(changed)
+		}
+		// Snapshot after the build, so its own writes to index.json don't
+		// trigger another one.
+		stamps = snapshot(paths)
+	}
+}
+
+// watch rebuilds the site whenever a file in the watch scope changes. Changes
+// to templates only render the pages again; any other change runs a full
+// build. With the template scope every rebuild only renders pages.
+func watch(cfg Config, opts buildOptions, scope string) {
+	paths := watchedPaths(cfg, scope)
+	fmt.Printf("Watching %s for changes...\n", strings.Join(paths, ", "))
+
+	watchChanges(paths, func(changed []string) {
+		fmt.Printf("Changed %s, rebuilding...\n", strings.Join(changed, ", "))
+		if _, err := build(cfg, rebuildOptions(opts, scope, changed)); err != nil {
+			fmt.Printf("Build failed: %v\n", err)
+		}
+	})
+}
+
+// rebuildOptions returns the options of a rebuild after changes, which only
+// renders pages when templates alone changed.
+func rebuildOptions(opts buildOptions, scope string, changed []string) buildOptions {
+	rebuild := opts
+	rebuild.Since = ""
+	rebuild.HTMLOnly = scope == "template" || onlyTemplates(changed)
+	return rebuild
+}
+
+// onlyTemplates reports whether every changed file is in the template directory.
+func onlyTemplates(changed []string) bool {
+	for _, path := range changed {
+		if !strings.HasPrefix(filepath.ToSlash(path), "template/") {
+			return false
+		}
+	}
+	return true
+}
+
+// validWatchScope reports whether scope is all or one of watchScopes.
+func validWatchScope(scope string) bool {
+	_, ok := watchScopes[scope]
+	return ok || scope == "all"
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// wxrExport is the part of a WordPress WXR export the importer reads.
+type wxrExport struct {
+	Items []wxrItem `xml:"channel>item"`
+}
+
+// wxrItem is a post, page or attachment of a WXR export. Fields are matched
+// by their local name, as the wp namespace changes with the export version.
+type wxrItem struct {
+	Title         string        `xml:"title"`
+	Content       string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	ID            string        `xml:"post_id"`
+	Parent        string        `xml:"post_parent"`
+	Date          string        `xml:"post_date"`
+	DateGMT       string        `xml:"post_date_gmt"`
+	Status        string        `xml:"status"`
+	Type          string        `xml:"post_type"`
+	AttachmentURL string        `xml:"attachment_url"`
+	Categories    []wxrCategory `xml:"category"`
+	Meta          []wxrMeta     `xml:"postmeta"`
+}
+
+type wxrCategory struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+type wxrMeta struct {
+	Key   string `xml:"meta_key"`
+	Value string `xml:"meta_value"`
+}
+
+// meta returns the value of the post meta key, if any.
+func (item wxrItem) meta(key string) string {
+	for _, meta := range item.Meta {
+		if meta.Key == key {
+			return meta.Value
+		}
+	}
+	return ""
+}
+
+// blockComment matches the comments the block editor wraps content in.
+var blockComment = regexp.MustCompile(`<!-- /?wp:.*? -->\n?`)
+
+// wxrDateLayout is the layout of the WXR post dates.
+const wxrDateLayout = "2006-01-02 15:04:05"
+
+// date returns the post date in a format of dateLayouts. Drafts may have no
+// GMT date, the local one is used then.
+func (item wxrItem) date() string {
+	if t, err := time.Parse(wxrDateLayout, item.DateGMT); err == nil && t.Year() > 1 {
+		return t.Format(time.RFC3339)
+	}
+	if t, err := time.Parse(wxrDateLayout, item.Date); err == nil && t.Year() > 1 {
+		return t.Format("2006-01-02")
+	}
+	return ""
+}
+
+// tags returns the categories and tags of the item, without WordPress's
+// default "Uncategorized" category.
+func (item wxrItem) tags() []string {
+	tags := []string{}
+	for _, category := range item.Categories {
+		if category.Domain != "category" && category.Domain != "post_tag" {
+			continue
+		}
+		if category.Domain == "category" && category.Nicename == "uncategorized" {
+			continue
+		}
+		name := strings.TrimSpace(category.Name)
+		if name != "" && !slices.Contains(tags, name) {
+			tags = append(tags, name)
+		}
+	}
+	return tags
+}
+
+// runImportWXR imports the posts of a WordPress WXR export into
+// source/index.json, copying their featured images into source/images.
+func runImportWXR(args []string) error {
+	flags := flag.NewFlagSet("import-wxr", flag.ExitOnError)
+	uploads := flags.String("uploads", "", "copy media from this local copy of wp-content/uploads instead of downloading it")
+	force := flags.Bool("force", false, "replace an existing index.json, keeping a backup")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: bricksling import-wxr [--uploads dir] [--force] export.xml")
+	}
+
+	indexJSONPath := "source/index.json"
+	imagesPath := "source/images"
+	current, err := os.ReadFile(indexJSONPath)
+	if err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to replace it", indexJSONPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var export wxrExport
+	err = xml.NewDecoder(file).Decode(&export)
+	if err != nil {
+		return fmt.Errorf("error parsing WXR export: %w", err)
+	}
+
+	posts, err := importWXRPosts(export, imagesPath, *uploads)
+	if err != nil {
+		return err
+	}
+
+	postsDataJSON, err := json.MarshalIndent(PostsData{Posts: posts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(indexJSONPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		err = os.WriteFile(indexJSONPath+".bak", current, 0644)
+		if err != nil {
+			return fmt.Errorf("error writing backup: %w", err)
+		}
+	}
+	err = os.WriteFile(indexJSONPath, postsDataJSON, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d posts into %s.\n", len(posts), indexJSONPath)
+	return nil
+}
+
+// importWXRPosts converts the posts of the export, newest first, copying
+// their images into imagesPath. Pages, attachments and other content types
+// are skipped, as are posts without an image. An image that can't be copied
+// is referenced by its URL instead.
+func importWXRPosts(export wxrExport, imagesPath string, uploads string) ([]Post, error) {
+	attachments := make(map[string]wxrItem)
+	for _, item := range export.Items {
+		if item.Type == "attachment" {
+			attachments[item.ID] = item
+		}
+	}
+
+	err := os.MkdirAll(imagesPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Images already in imagesPath are kept, imported ones get another name.
+	entries, err := os.ReadDir(imagesPath)
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool)
+	for _, entry := range entries {
+		taken[entry.Name()] = true
+	}
+
+	var posts []Post
+	client := &http.Client{Timeout: time.Minute}
+	for _, item := range export.Items {
+		if item.Type != "post" || item.Status == "trash" || item.Status == "auto-draft" {
+			continue
+		}
+
+		attachment, ok := featuredImage(item, export.Items, attachments)
+		if !ok {
+			fmt.Printf("Skipping %q, it has no image.\n", item.Title)
+			continue
+		}
+
+		image, err := importWXRImage(attachment.AttachmentURL, imagesPath, uploads, taken, client)
+		if err != nil {
+			fmt.Printf("Warning: %q keeps its image URL: %v\n", item.Title, err)
+			image = attachment.AttachmentURL
+		}
+
+		posts = append(posts, Post{
+			Title:   strings.TrimSpace(item.Title),
+			Caption: strings.TrimSpace(blockComment.ReplaceAllString(item.Content, "")),
+			Image:   image,
+			Alt:     attachment.meta("_wp_attachment_image_alt"),
+			Tags:    item.tags(),
+			Date:    item.date(),
+			Draft:   item.Status != "publish" && item.Status != "future",
+		})
+	}
+	return sortedByDate(posts, time.UTC), nil
+}
+
+// featuredImage returns the featured image attachment of the post or, when it
+// has none, the first image attached to it.
+func featuredImage(post wxrItem, items []wxrItem, attachments map[string]wxrItem) (wxrItem, bool) {
+	if attachment, ok := attachments[post.meta("_thumbnail_id")]; ok && attachment.AttachmentURL != "" {
+		return attachment, true
+	}
+	for _, item := range items {
+		if item.Type == "attachment" && item.Parent == post.ID && isImageURL(item.AttachmentURL) {
+			return item, true
+		}
+	}
+	return wxrItem{}, false
+}
+
+// isImageURL reports whether the attachment URL has an image extension.
+func isImageURL(rawURL string) bool {
+	switch strings.ToLower(pathpkg.Ext(rawURL)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// importWXRImage copies the attachment into imagesPath, from the uploads
+// directory when set and downloading it otherwise, and returns its name.
+// Attachments sharing a name with each other or with an image in imagesPath
+// get a numbered suffix, as images are looked up by name. The image is
+// written through a temporary file, so a failed copy leaves nothing behind.
+func importWXRImage(rawURL string, imagesPath string, uploads string, taken map[string]bool, client *http.Client) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Path == "" {
+		return "", fmt.Errorf("invalid attachment URL %q", rawURL)
+	}
+
+	base := pathpkg.Base(parsed.Path)
+	ext := pathpkg.Ext(base)
+	name := base
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), i, ext)
+	}
+
+	var src io.ReadCloser
+	if uploads != "" {
+		_, rel, found := strings.Cut(parsed.Path, "/wp-content/uploads/")
+		if !found {
+			rel = strings.TrimPrefix(parsed.Path, "/")
+		}
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return "", fmt.Errorf("attachment path %q is outside the uploads directory", rel)
+		}
+		src, err = os.Open(filepath.Join(uploads, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		resp, err := client.Get(rawURL)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("downloading %s: %s", rawURL, resp.Status)
+		}
+		src = resp.Body
+	}
+	defer src.Close()
+
+	err = writeFileAtomic(filepath.Join(imagesPath, name), func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	taken[name] = true
+	fmt.Printf("Imported image: %s\n", name)
+	return name, nil
+}
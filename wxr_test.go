@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestImportWXRPostsFromUploads(t *testing.T) {
+	dir := t.TempDir()
+	uploads := filepath.Join(dir, "uploads")
+	imagesPath := filepath.Join(dir, "images")
+	writeTestFile(t, filepath.Join(uploads, "2024/05/a.jpg"), "new")
+	writeTestFile(t, filepath.Join(imagesPath, "a.jpg"), "existing")
+	// A directory opens fine but fails to copy.
+	if err := os.MkdirAll(filepath.Join(uploads, "2024/05/broken.jpg"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	const prefix = "https://example.com/wp-content/uploads/"
+	post := func(id string, title string) wxrItem {
+		return wxrItem{ID: id, Title: title, Type: "post", Status: "publish"}
+	}
+	attachment := func(parent string, path string) wxrItem {
+		return wxrItem{ID: parent + "0", Parent: parent, Type: "attachment", AttachmentURL: prefix + path}
+	}
+	export := wxrExport{Items: []wxrItem{
+		post("1", "Clashing"), attachment("1", "2024/05/a.jpg"),
+		post("2", "Escaping"), attachment("2", "../../secret.jpg"),
+		post("3", "Broken"), attachment("3", "2024/05/broken.jpg"),
+	}}
+
+	posts, err := importWXRPosts(export, imagesPath, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := make(map[string]string)
+	for _, post := range posts {
+		images[post.Title] = post.Image
+	}
+	want := map[string]string{
+		"Clashing": "a-2.jpg",
+		"Escaping": prefix + "../../secret.jpg",
+		"Broken":   prefix + "2024/05/broken.jpg",
+	}
+	for title, image := range want {
+		if images[title] != image {
+			t.Errorf("%s has image %q, want %q", title, images[title], image)
+		}
+	}
+
+	if got := readTestFile(t, filepath.Join(imagesPath, "a.jpg")); got != "existing" {
+		t.Errorf("existing a.jpg was overwritten with %q", got)
+	}
+	if got := readTestFile(t, filepath.Join(imagesPath, "a-2.jpg")); got != "new" {
+		t.Errorf("a-2.jpg has %q, want the uploaded image", got)
+	}
+	entries, err := os.ReadDir(imagesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"a-2.jpg", "a.jpg"}; !slices.Equal(names, want) {
+		t.Errorf("images are %v, want %v", names, want)
+	}
+}